@@ -0,0 +1,139 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package api
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+
+	// Returned by reader of request stream requester aborted
+	// before it sent whole body
+	ErrStreamAborted = errors.New("Request stream is aborted by requester")
+)
+
+//
+// ChunkStream delivers body chunks of streaming
+// request in order they came
+//
+type ChunkStream struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	// Chunks pushed but not yet consumed
+	queue [][]byte
+
+	// Indicates that end of stream was pushed
+	ended bool
+
+	// Error stream was aborted with, nil if it ended normally
+	err error
+
+	// Optional callback called once chunk is consumed,
+	// used to grant requester credit for more chunks
+	OnNext func()
+}
+
+//
+// NewChunkStream creates new empty chunk stream
+//
+func NewChunkStream() *ChunkStream {
+
+	s := &ChunkStream{
+		queue: [][]byte{},
+	}
+
+	s.cond = sync.NewCond(s)
+	return s
+}
+
+//
+// Push appends chunk to the stream. Chunks that came
+// after end of stream are dropped
+//
+func (s *ChunkStream) Push(chunk []byte) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ended {
+		return
+	}
+
+	s.queue = append(s.queue, chunk)
+	s.cond.Signal()
+}
+
+//
+// End marks end of stream. Chunks already pushed are still delivered
+//
+func (s *ChunkStream) End() {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.ended = true
+	s.cond.Broadcast()
+}
+
+//
+// Abort marks end of stream that did not carry whole body.
+// Chunks already pushed are still delivered, then Err returns err
+//
+func (s *ChunkStream) Abort(err error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ended {
+		return
+	}
+
+	s.ended = true
+	s.err = err
+	s.cond.Broadcast()
+}
+
+//
+// Err returns error stream was aborted with, nil if it was not
+//
+func (s *ChunkStream) Err() error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.err
+}
+
+//
+// Next blocks until next chunk is available and returns it.
+// Returns false when stream is ended and all chunks consumed
+//
+func (s *ChunkStream) Next() ([]byte, bool) {
+
+	s.Lock()
+
+	for len(s.queue) == 0 {
+		if s.ended {
+			s.Unlock()
+			return nil, false
+		}
+		s.cond.Wait()
+	}
+
+	chunk := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+
+	s.Unlock()
+
+	if s.OnNext != nil {
+		s.OnNext()
+	}
+
+	return chunk, true
+}
@@ -0,0 +1,76 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package api
+
+import (
+	"context"
+	"sync"
+)
+
+//
+// Delivery reports outcome of sending acknowledged event
+//
+type Delivery struct {
+	once sync.Once
+	done chan struct{}
+
+	// Nil if event was confirmed, set once done is closed
+	err error
+}
+
+//
+// NewDelivery creates new unresolved delivery
+//
+func NewDelivery() *Delivery {
+	return &Delivery{
+		done: make(chan struct{}),
+	}
+}
+
+//
+// Resolve sets outcome of delivery, nil if event was confirmed.
+// Only first call has effect
+//
+func (d *Delivery) Resolve(err error) {
+	d.once.Do(func() {
+		d.err = err
+		close(d.done)
+	})
+}
+
+//
+// Done returns channel that is closed once outcome is known
+//
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+//
+// Err returns error of failed delivery. It is nil while
+// delivery is in progress and once event is confirmed
+//
+func (d *Delivery) Err() error {
+
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+//
+// Wait blocks until outcome of delivery is known and returns
+// its error, or returns error of ctx if it is done before
+//
+func (d *Delivery) Wait(ctx context.Context) error {
+
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -5,6 +5,7 @@
 package api
 
 import (
+	"context"
 	"github.com/satori/go.uuid"
 	"github.com/yyyar/yamp-go/format"
 	"github.com/yyyar/yamp-go/parser"
@@ -25,6 +26,22 @@ type Event struct {
 
 	// event frame
 	Frame parser.Event
+
+	// context of event handling, carrying its trace
+	Ctx context.Context
+}
+
+//
+// Context returns context of event handling. Pass it
+// to calls made by handler to continue trace
+//
+func (e *Event) Context() context.Context {
+
+	if e.Ctx == nil {
+		return context.Background()
+	}
+
+	return e.Ctx
 }
 
 //
@@ -41,6 +58,13 @@ func (e *Event) Read(to interface{}) {
 	e.BodyFormat.Parse(e.Frame.Body, to)
 }
 
+//
+// Header returns metadata headers of event
+//
+func (e *Event) Header() parser.Metadata {
+	return e.Frame.Metadata
+}
+
 //
 // RawBody returns event data as a raw (unparsed) byte array
 //
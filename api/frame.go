@@ -0,0 +1,14 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package api
+
+import (
+	"github.com/yyyar/yamp-go/parser"
+)
+
+//
+// FrameHandler handles incoming extension (custom) frame
+//
+type FrameHandler func(parser.Frame)
@@ -0,0 +1,137 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package api
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+)
+
+var (
+
+	// Returned by Any called without futures, since none would finish
+	ErrNoFutures = errors.New("No futures to wait for")
+)
+
+//
+// Future is terminal response of request that will be available later
+//
+type Future struct {
+	once sync.Once
+	done chan struct{}
+
+	// Terminal response, set once done is closed
+	response *Response
+}
+
+//
+// NewFuture creates new unresolved future
+//
+func NewFuture() *Future {
+	return &Future{
+		done: make(chan struct{}),
+	}
+}
+
+//
+// Resolve sets terminal response of future. Progress responses and
+// responses after first terminal one are ignored, so Resolve
+// may be used as ResponseHandler
+//
+func (f *Future) Resolve(response *Response) {
+
+	if response.IsProgress() {
+		return
+	}
+
+	f.once.Do(func() {
+		f.response = response
+		close(f.done)
+	})
+}
+
+//
+// Done returns channel that is closed once terminal response is available
+//
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+//
+// Result returns terminal response, or nil if it is not available yet
+//
+func (f *Future) Result() *Response {
+
+	select {
+	case <-f.done:
+		return f.response
+	default:
+		return nil
+	}
+}
+
+//
+// Wait blocks until terminal response is available and returns
+// it, or returns error if ctx is done before
+//
+func (f *Future) Wait(ctx context.Context) (*Response, error) {
+
+	select {
+	case <-f.done:
+		return f.response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//
+// All waits for terminal responses of all futures and returns them
+// in order of futures. Error responses don't stop waiting for others,
+// only ctx being done does, in which case its error is returned
+//
+func All(ctx context.Context, futures ...*Future) ([]*Response, error) {
+
+	responses := make([]*Response, len(futures))
+
+	for i, future := range futures {
+		response, err := future.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		responses[i] = response
+	}
+
+	return responses, nil
+}
+
+//
+// Any waits for first terminal response of any of futures and returns
+// index of future it belongs to. Returns error if ctx is done before,
+// or ErrNoFutures at once if there are no futures
+//
+func Any(ctx context.Context, futures ...*Future) (int, *Response, error) {
+
+	if len(futures) == 0 {
+		return -1, nil, ErrNoFutures
+	}
+
+	cases := make([]reflect.SelectCase, len(futures)+1)
+
+	for i, future := range futures {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(future.done)}
+	}
+
+	cases[len(futures)] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+
+	i, _, _ := reflect.Select(cases)
+
+	if i == len(futures) {
+		return -1, nil, ctx.Err()
+	}
+
+	return i, futures[i].response, nil
+}
@@ -5,9 +5,35 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"github.com/satori/go.uuid"
 	"github.com/yyyar/yamp-go/format"
 	"github.com/yyyar/yamp-go/parser"
+	"io"
+)
+
+var (
+
+	// Returned (or sent as error response body) when
+	// deadline of request passed before it was finished
+	ErrDeadlineExceeded = errors.New("Request deadline exceeded")
+
+	// Returned when limit of outstanding requests is reached
+	ErrTooManyPending = errors.New("Too many pending requests")
+
+	// Returned when request with the same uid is pending already
+	ErrDuplicateUid = errors.New("Request with the same uid is pending")
+
+	// Sent as error response body when responder has no
+	// handler for uri of streaming request, or of any request
+	// if automatic error responses are enabled
+	ErrNoHandler = errors.New("No handler for uri")
+
+	// Returned (or sent as error response body) when connection
+	// is closed before request was sent or finished
+	ErrClosed = errors.New("Connection is closed")
 )
 
 //
@@ -25,6 +51,12 @@ type Request struct {
 
 	// request frame
 	Frame parser.Request
+
+	// body chunks of streaming request, nil for regular one
+	Chunks *ChunkStream
+
+	// context done when request deadline passes or terminal response is sent
+	Ctx context.Context
 }
 
 //
@@ -41,9 +73,109 @@ func (r *Request) Read(to interface{}) {
 	r.BodyFormat.Parse(r.Frame.Body, to)
 }
 
+//
+// Context returns context of request carrying its deadline set by
+// requester. It is done once deadline passes or terminal response
+// is sent. Pass it to nested calls to propagate deadline further
+//
+func (r *Request) Context() context.Context {
+
+	if r.Ctx == nil {
+		return context.Background()
+	}
+
+	return r.Ctx
+}
+
+//
+// Header returns metadata headers of request
+//
+func (r *Request) Header() parser.Metadata {
+	return r.Frame.Metadata
+}
+
 //
 // RawBody returns raw (unparsed) request body as byte array
 //
 func (r *Request) RawBody() []byte {
 	return r.Frame.Body
 }
+
+//
+// IsStreaming indicates that request body continues in chunks
+//
+func (r *Request) IsStreaming() bool {
+	return r.Chunks != nil
+}
+
+//
+// NextChunk returns next raw body chunk of streaming request.
+// Returns false when requester ended the stream
+//
+func (r *Request) NextChunk() ([]byte, bool) {
+
+	if r.Chunks == nil {
+		return nil, false
+	}
+
+	return r.Chunks.Next()
+}
+
+//
+// ReadChunk reads (parses) next body chunk of streaming request
+// into object. Returns false when requester ended the stream, with
+// ErrStreamAborted if requester failed to send whole body
+//
+func (r *Request) ReadChunk(to interface{}) (bool, error) {
+
+	chunk, ok := r.NextChunk()
+	if !ok {
+		if r.Chunks != nil {
+			return false, r.Chunks.Err()
+		}
+		return false, nil
+	}
+
+	return true, r.BodyFormat.Parse(chunk, to)
+}
+
+//
+// BodyReader returns reader of raw request body. For streaming
+// request it reads chunks as they come, one after another, and
+// fails with ErrStreamAborted if requester failed to send whole body
+//
+func (r *Request) BodyReader() io.Reader {
+
+	if r.Chunks == nil {
+		return bytes.NewReader(r.Frame.Body)
+	}
+
+	return &chunksReader{chunks: r.Chunks}
+}
+
+//
+// chunksReader reads chunks of streaming request as continuous body
+//
+type chunksReader struct {
+	chunks *ChunkStream
+	chunk  []byte
+}
+
+func (c *chunksReader) Read(p []byte) (int, error) {
+
+	for len(c.chunk) == 0 {
+		chunk, ok := c.chunks.Next()
+		if !ok {
+			if err := c.chunks.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		c.chunk = chunk
+	}
+
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+
+	return n, nil
+}
@@ -0,0 +1,124 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package api
+
+import (
+	"errors"
+	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/ids"
+	"github.com/yyyar/yamp-go/parser"
+	"sync"
+)
+
+var (
+
+	// Returned on attempt to write to closed request stream
+	ErrStreamClosed = errors.New("Request stream is closed")
+)
+
+//
+// RequestWriter sends body chunks of streaming request
+//
+type RequestWriter struct {
+
+	// Body serialization format
+	BodyFormat format.BodyFormat
+
+	// Output channel to push chunks
+	Out chan parser.Frame
+
+	// Streaming request frame chunks belong to
+	RequestFrame *parser.Request
+
+	// Generator of chunks uids. Defaults to ids.Default
+	IdGenerator ids.Generator
+
+	// Credit granted by responder for body chunks, nil if flow
+	// control is off. Write blocks until there is credit
+	Window *Window
+
+	// Guards closed and ordering of sent chunks
+	mutex sync.Mutex
+
+	// Indicates that end of stream was sent
+	closed bool
+}
+
+//
+// Write serializes object and sends it as next body chunk
+//
+func (w *RequestWriter) Write(obj interface{}) error {
+
+	b, err := w.BodyFormat.Serialize(obj)
+	if err != nil {
+		return err
+	}
+
+	return w.WriteRaw(b)
+}
+
+//
+// WriteRaw sends raw (unserialized) bytes as next body chunk
+//
+func (w *RequestWriter) WriteRaw(b []byte) error {
+
+	if w.Window != nil {
+		if err := w.Window.Acquire(); err != nil {
+			return ErrStreamClosed
+		}
+	}
+
+	return w.send(&parser.StreamChunk{
+		UserBody: parser.UserBody{
+			Body: b,
+		},
+	})
+}
+
+//
+// Close sends end of request stream marker
+//
+func (w *RequestWriter) Close() error {
+	return w.send(&parser.StreamChunk{End: true})
+}
+
+//
+// Abort sends end of request stream marker telling responder
+// that body is incomplete because of err
+//
+func (w *RequestWriter) Abort(err error) error {
+	return w.send(&parser.StreamChunk{
+		End:     true,
+		Aborted: true,
+		UserBody: parser.UserBody{
+			Body: []byte(err.Error()),
+		},
+	})
+}
+
+//
+// Send chunk frame out for delivery to other party
+//
+func (w *RequestWriter) send(chunk *parser.StreamChunk) error {
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrStreamClosed
+	}
+
+	w.closed = chunk.End
+
+	chunk.UserHeader = parser.UserHeader{
+		Uid: ids.Generate(w.IdGenerator),
+		Uri: w.RequestFrame.Uri,
+	}
+	chunk.RequestUid = w.RequestFrame.Uid
+
+	w.Out <- chunk
+
+	return nil
+}
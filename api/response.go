@@ -5,9 +5,25 @@
 package api
 
 import (
+	"errors"
 	"github.com/satori/go.uuid"
 	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/ids"
 	"github.com/yyyar/yamp-go/parser"
+	"sync"
+)
+
+var (
+
+	// Returned on attempt to respond after terminal response was sent
+	ErrResponseFinished = errors.New("Terminal response was already sent")
+
+	// Returned on attempt to respond on received (not outgoing) response
+	ErrNotResponder = errors.New("Response is not bound to request")
+
+	// Returned on attempt to use protocol feature
+	// that was not negotiated in handshake
+	ErrNotNegotiated = errors.New("Protocol feature was not negotiated")
 )
 
 //
@@ -29,8 +45,33 @@ type Response struct {
 	// Optional request frame for this response
 	RequestFrame *parser.Request
 
-	// Response frame
+	// Response frame, last sent one for outgoing responses
 	Frame *parser.Response
+
+	// Optional flow control window limiting progress responses
+	Window *Window
+
+	// Optional callback called once terminal response is sent
+	OnFinish func()
+
+	// Indicates that metadata headers were negotiated and can be set
+	AllowHeader bool
+
+	// Protocol version negotiated with requester, before varint
+	// lengths it limits length of metadata header fields
+	Version uint16
+
+	// Generator of response uids. Defaults to ids.Default
+	IdGenerator ids.Generator
+
+	// Metadata headers attached to sent responses
+	header parser.Metadata
+
+	// Guards finished and ordering of sent responses
+	mutex sync.Mutex
+
+	// Indicates that terminal response was sent
+	finished bool
 }
 
 //
@@ -61,6 +102,44 @@ func (r *Response) Read(to interface{}) {
 	r.BodyFormat.Parse(r.Frame.Body, to)
 }
 
+//
+// Header returns metadata headers of received response
+//
+func (r *Response) Header() parser.Metadata {
+
+	if r.Frame == nil {
+		return nil
+	}
+
+	return r.Frame.Metadata
+}
+
+//
+// SetHeader sets metadata header attached to all responses sent after.
+// Fails with parser.ErrFieldTooLong if header does not fit into response
+// of negotiated protocol version
+//
+func (r *Response) SetHeader(key, value string) error {
+
+	if !r.AllowHeader {
+		return ErrNotNegotiated
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Copy, as already sent responses may still be serialized
+	header := r.header.With(key, value)
+
+	if err := parser.CheckMetadata(r.Version, header); err != nil {
+		return err
+	}
+
+	r.header = header
+
+	return nil
+}
+
 //
 // IsDone indicates that this is successed response
 //
@@ -82,38 +161,108 @@ func (r *Response) IsProgress() bool {
 	return r.Frame.Type == parser.RESPONSE_PROGRESS
 }
 
+//
+// IsCancelled indicates that request was cancelled
+//
+func (r *Response) IsCancelled() bool {
+	return r.Frame.Type == parser.RESPONSE_CANCELLED
+}
+
+//
+// IsFinished indicates that terminal (done or error)
+// response was already sent
+//
+func (r *Response) IsFinished() bool {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.finished
+}
+
 //
 // Done sends done response to requester party
 //
-func (r *Response) Done(obj interface{}) {
-	r.send(parser.RESPONSE_DONE, obj)
+func (r *Response) Done(obj interface{}) error {
+	return r.send(parser.RESPONSE_DONE, obj)
 }
 
 //
 // Error sends error response to requester party
 //
-func (r *Response) Error(obj interface{}) {
-	r.send(parser.RESPONSE_ERROR, obj)
+func (r *Response) Error(obj interface{}) error {
+	return r.send(parser.RESPONSE_ERROR, obj)
+}
+
+//
+// Progress sends progress response to requester party.
+// Blocks until requester grants credit if flow control is on
+//
+func (r *Response) Progress(obj interface{}) error {
+
+	if r.Window != nil {
+		if err := r.Window.Acquire(); err != nil {
+			return r.windowError(err)
+		}
+	}
+
+	return r.send(parser.RESPONSE_PROGRESS, obj)
+}
+
+//
+// TryProgress sends progress response same as Progress, but
+// returns ErrNoCredit instead of blocking when out of credit
+//
+func (r *Response) TryProgress(obj interface{}) error {
+
+	if r.Window != nil {
+		if err := r.Window.TryAcquire(); err != nil {
+			return r.windowError(err)
+		}
+	}
+
+	return r.send(parser.RESPONSE_PROGRESS, obj)
 }
 
 //
-// Progress sends done response to requester party
+// Window gets closed on terminal response, report it as such
 //
-func (r *Response) Progress(obj interface{}) {
-	r.send(parser.RESPONSE_PROGRESS, obj)
+func (r *Response) windowError(err error) error {
+
+	if err == ErrWindowClosed && r.IsFinished() {
+		return ErrResponseFinished
+	}
+
+	return err
 }
 
 //
-// Serialize body and send out for delivery to other party
+// Serialize body and send out for delivery to other party.
+// Nothing is sent once terminal response went out
 //
-func (r *Response) send(t parser.ResponseType, obj interface{}) {
+func (r *Response) send(t parser.ResponseType, obj interface{}) error {
 
-	b, _ := r.BodyFormat.Serialize(obj)
+	if r.RequestFrame == nil || r.Out == nil {
+		return ErrNotResponder
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.finished {
+		return ErrResponseFinished
+	}
+
+	b, err := r.BodyFormat.Serialize(obj)
+	if err != nil {
+		return err
+	}
 
 	response := parser.Response{
 		UserHeader: parser.UserHeader{
-			Uid: uuid.NewV1(),
-			Uri: r.RequestFrame.Uri,
+			Uid:      ids.Generate(r.IdGenerator),
+			Uri:      r.RequestFrame.Uri,
+			Metadata: r.header,
 		},
 		RequestUid: r.RequestFrame.Uid,
 		Type:       t,
@@ -122,5 +271,18 @@ func (r *Response) send(t parser.ResponseType, obj interface{}) {
 		},
 	}
 
+	r.finished = t != parser.RESPONSE_PROGRESS
+	r.Frame = &response
 	r.Out <- &response
+
+	if r.finished {
+		if r.Window != nil {
+			r.Window.Close()
+		}
+		if r.OnFinish != nil {
+			r.OnFinish()
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,88 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package api
+
+import (
+	"sync"
+)
+
+//
+// ResponseStream delivers all responses of a single request
+// (progress ones followed by terminal one) in order they came
+//
+type ResponseStream struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	// Responses pushed but not yet consumed
+	queue []*Response
+
+	// Indicates that terminal response was pushed
+	finished bool
+
+	// Optional callback called for every response returned by Next
+	OnNext func(*Response)
+}
+
+//
+// NewResponseStream creates new empty response stream
+//
+func NewResponseStream() *ResponseStream {
+
+	s := &ResponseStream{
+		queue: []*Response{},
+	}
+
+	s.cond = sync.NewCond(s)
+	return s
+}
+
+//
+// Push appends response to the stream. Responses that came
+// after terminal one are dropped
+//
+func (s *ResponseStream) Push(response *Response) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.finished {
+		return
+	}
+
+	s.queue = append(s.queue, response)
+	s.finished = !response.IsProgress()
+
+	s.cond.Signal()
+}
+
+//
+// Next blocks until next response is available and returns it.
+// Returns false when terminal response was already consumed
+//
+func (s *ResponseStream) Next() (*Response, bool) {
+
+	s.Lock()
+
+	for len(s.queue) == 0 {
+		if s.finished {
+			s.Unlock()
+			return nil, false
+		}
+		s.cond.Wait()
+	}
+
+	response := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+
+	s.Unlock()
+
+	if s.OnNext != nil {
+		s.OnNext(response)
+	}
+
+	return response, true
+}
@@ -0,0 +1,158 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package api
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+
+	// Returned on subscribe with buffer that can't hold events
+	// overflow policy needs
+	ErrBufferSize = errors.New("Invalid subscription buffer size")
+)
+
+//
+// Overflow is policy of subscription which buffer is full
+//
+type Overflow uint8
+
+const (
+
+	// Wait for consumer to free buffer. Stalls delivery of all
+	// incoming frames of connection until it does
+	OVERFLOW_BLOCK Overflow = iota
+
+	// Drop oldest buffered event to make room for new one.
+	// Needs buffer of at least one event
+	OVERFLOW_DROP_OLDEST
+
+	// Drop new event
+	OVERFLOW_DROP_NEWEST
+)
+
+//
+// Subscription delivers events of uri to channel in order they came
+//
+type Subscription struct {
+	mutex sync.Mutex
+
+	Uri      string
+	Overflow Overflow
+
+	events chan *Event
+
+	// Closed on unsubscribe, to release blocked delivery
+	done chan struct{}
+	once sync.Once
+
+	// Number of events dropped because of overflow
+	dropped uint64
+
+	// Called once on unsubscribe
+	OnUnsubscribe func()
+}
+
+//
+// NewSubscription creates subscription buffering up to bufferSize events
+//
+func NewSubscription(uri string, bufferSize int, overflow Overflow) *Subscription {
+	return &Subscription{
+		Uri:      uri,
+		Overflow: overflow,
+		events:   make(chan *Event, bufferSize),
+		done:     make(chan struct{}),
+	}
+}
+
+//
+// Events returns channel of events. It is closed on unsubscribe
+//
+func (s *Subscription) Events() <-chan *Event {
+	return s.events
+}
+
+//
+// Dropped returns number of events dropped because of overflow
+//
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+//
+// Push delivers event to channel according to overflow policy
+//
+func (s *Subscription) Push(event *Event) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	switch s.Overflow {
+
+	case OVERFLOW_DROP_NEWEST:
+		select {
+		case s.events <- event:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+
+	case OVERFLOW_DROP_OLDEST:
+
+		// Without buffer there is nothing to drop to make room
+		if cap(s.events) == 0 {
+			atomic.AddUint64(&s.dropped, 1)
+			return
+		}
+
+		for {
+			select {
+			case s.events <- event:
+				return
+			default:
+			}
+
+			// Consumer may take oldest one concurrently
+			select {
+			case <-s.events:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case s.events <- event:
+		case <-s.done:
+		}
+	}
+}
+
+//
+// Unsubscribe stops delivery and closes events channel
+//
+func (s *Subscription) Unsubscribe() {
+
+	s.once.Do(func() {
+
+		close(s.done)
+
+		if s.OnUnsubscribe != nil {
+			s.OnUnsubscribe()
+		}
+
+		s.mutex.Lock()
+		close(s.events)
+		s.mutex.Unlock()
+	})
+}
@@ -0,0 +1,106 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package api
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+
+	// Returned by non-blocking send when there is no credit left
+	ErrNoCredit = errors.New("No flow control credit left")
+
+	// Returned on waiting for credit of closed window
+	ErrWindowClosed = errors.New("Flow control window is closed")
+)
+
+//
+// Window is responder side flow control window of a single
+// request: credit granted by requester for progress responses
+//
+type Window struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	// Number of progress responses allowed to send
+	credit uint32
+
+	// Indicates that no more credit will be granted
+	closed bool
+}
+
+//
+// NewWindow creates window with no credit
+//
+func NewWindow() *Window {
+	w := &Window{}
+	w.cond = sync.NewCond(w)
+	return w
+}
+
+//
+// Grant adds credit to window and wakes up waiting senders
+//
+func (w *Window) Grant(credit uint32) {
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.credit += credit
+	w.cond.Broadcast()
+}
+
+//
+// Acquire takes single credit, blocking until it is granted
+//
+func (w *Window) Acquire() error {
+
+	w.Lock()
+	defer w.Unlock()
+
+	for w.credit == 0 {
+		if w.closed {
+			return ErrWindowClosed
+		}
+		w.cond.Wait()
+	}
+
+	w.credit--
+	return nil
+}
+
+//
+// TryAcquire takes single credit without blocking
+//
+func (w *Window) TryAcquire() error {
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return ErrWindowClosed
+	}
+
+	if w.credit == 0 {
+		return ErrNoCredit
+	}
+
+	w.credit--
+	return nil
+}
+
+//
+// Close releases senders waiting for credit
+//
+func (w *Window) Close() {
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.closed = true
+	w.cond.Broadcast()
+}
@@ -0,0 +1,159 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"errors"
+	"github.com/yyyar/yamp-go/parser"
+	"io"
+	"net"
+)
+
+var (
+
+	// Returned by flush marker if it gets serialized by mistake
+	errFlushMarker = errors.New("Flush marker is not a frame")
+)
+
+//
+// writeBatch coalesces serialized frames to write them to
+// transport at once. Network connections get frames with
+// single writev, other transports get them copied into single buffer
+//
+type writeBatch struct {
+	writer  io.Writer
+	maxSize int
+
+	// Indicates that writer is network connection supporting writev
+	vectored bool
+
+	// Serialized frames waiting to be written
+	writers []*parser.Writer
+	buffers net.Buffers
+
+	// Number of bytes waiting to be written
+	size int
+
+	// First error writing to transport, if there was one
+	err error
+}
+
+//
+// Create batch writing to writer and flushing
+// once maxSize bytes are collected
+//
+func newWriteBatch(writer io.Writer, maxSize int) *writeBatch {
+
+	_, vectored := writer.(net.Conn)
+
+	return &writeBatch{
+		writer:   writer,
+		maxSize:  maxSize,
+		vectored: vectored,
+	}
+}
+
+//
+// Add serialized frame to batch, batch takes ownership of writer
+//
+func (b *writeBatch) add(writer *parser.Writer) error {
+
+	b.size += writer.Len()
+
+	if b.vectored || len(b.writers) == 0 {
+		b.writers = append(b.writers, writer)
+	} else {
+		b.writers[0].Write(writer.Bytes())
+		parser.ReleaseWriter(writer)
+	}
+
+	if b.size >= b.maxSize {
+		return b.flush()
+	}
+
+	return nil
+}
+
+//
+// Write all collected frames
+//
+func (b *writeBatch) flush() error {
+
+	if len(b.writers) == 0 {
+		return nil
+	}
+
+	var err error
+
+	if b.vectored {
+
+		b.buffers = b.buffers[:0]
+		for _, writer := range b.writers {
+			b.buffers = append(b.buffers, writer.Bytes())
+		}
+
+		// net.Buffers are consumed while written, so keep
+		// the slice itself to reuse it next time
+		buffers := b.buffers
+		_, err = buffers.WriteTo(b.writer)
+
+	} else {
+		_, err = b.writer.Write(b.writers[0].Bytes())
+	}
+
+	for i, writer := range b.writers {
+		parser.ReleaseWriter(writer)
+		b.writers[i] = nil
+	}
+
+	b.writers = b.writers[:0]
+	b.size = 0
+
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+
+	return err
+}
+
+//
+// flushMarker is queued to lane after frames to learn once they were
+// written. It is never serialized, write loop flushes batch and reports
+// first write error of connection to done instead
+//
+type flushMarker struct {
+	done chan error
+}
+
+func (m *flushMarker) GetType() parser.FrameType {
+	return parser.FrameType(0)
+}
+
+func (m *flushMarker) Parse(reader *parser.Reader) error {
+	return errFlushMarker
+}
+
+func (m *flushMarker) Serialize(writer *parser.Writer) error {
+	return errFlushMarker
+}
+
+//
+// Wait until frames queued to lanes of priorities so far are written.
+// Returns first error writing to transport
+//
+func (c *Connection) flush(priorities ...Priority) error {
+
+	for _, priority := range priorities {
+
+		marker := &flushMarker{done: make(chan error, 1)}
+		c.lane(priority) <- marker
+
+		if err := <-marker.done; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -5,23 +5,63 @@
 package yamp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/satori/go.uuid"
 	"github.com/yyyar/yamp-go/api"
 	"github.com/yyyar/yamp-go/dealers"
 	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/ids"
+	"github.com/yyyar/yamp-go/logging"
+	"github.com/yyyar/yamp-go/metrics"
 	"github.com/yyyar/yamp-go/parser"
+	"github.com/yyyar/yamp-go/trace"
 	"github.com/yyyar/yamp-go/transport"
-	"log"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+
+	// Returned when operation requires protocol feature
+	// that was not negotiated in handshake
+	ErrNotNegotiated = api.ErrNotNegotiated
+
+	// Returned when request can't be sent because of
+	// Options.MaxPendingRequests limit
+	ErrTooManyPending = api.ErrTooManyPending
+
+	// Returned when request uid supplied by caller (WithUid,
+	// WithIdempotencyKey) is used by pending request
+	ErrDuplicateUid = api.ErrDuplicateUid
+
+	// Returned by SubscribeWithOverflow with buffer size
+	// that overflow policy can't work with
+	ErrBufferSize = api.ErrBufferSize
+
+	// Body of error response to streaming request other party has
+	// no handler for, or to any such request if it enabled
+	// automatic error responses (Options.EnableNoResponseError)
+	ErrNoHandler = api.ErrNoHandler
 )
 
 const (
 
 	// Implemented Yamp Version
-	YAMP_VERSION = 0x01
+	YAMP_VERSION = 0x03
+
+	// Oldest Yamp Version still supported
+	YAMP_MIN_VERSION = 0x01
 )
 
+//
+// Number of connections created in process, used for their ids
+//
+var connectionsCount uint64
+
 // Connection is Yamp connection abstraction supports
 // events sending/handling and request/response
 // processing
@@ -33,18 +73,66 @@ type Connection struct {
 	// Transport connection adapter
 	conn transport.Connection
 
-	// Yamp protocol parser
+	// Reader of frames, used directly during handshake
+	reader *parser.Reader
+
+	// Yamp protocol parser, started after handshake
 	parser *parser.Parser
 
 	// User frames body format parser/serializer
 	bodyFormat format.BodyFormat
 
-	// Channel for pushing frames that will be written to other party
+	// Connection settings
+	options Options
+
+	// Unique id of connection within process
+	id uint64
+
+	// Logger attaching connection id to messages
+	logger logging.Logger
+
+	// Metrics of connection, aggregated in process ones
+	metrics *metrics.Metrics
+
+	// Pings waiting for ack by payload
+	pings      map[string]chan error
+	pingsLock  sync.Mutex
+	pingsCount uint64
+
+	// Protocol version and features negotiated in handshake
+	version  uint16
+	features uint32
+
+	// Current State, accessed atomically, and handlers of its changes
+	state             uint32
+	stateHandlers     []StateHandler
+	stateHandlersLock sync.RWMutex
+
+	// Other party sent close frame. Accessed only by read loop
+	closeReceived bool
+
+	// Acked events waiting for confirmation
+	outbox *Outbox
+
+	// Channels for pushing frames that will be written to other party,
+	// one per priority. framesOut is the one of normal priority
+	lanes     []chan parser.Frame
 	framesOut chan (parser.Frame)
 
-	*dealers.EventDealer
-	*dealers.RequestDealer
-	*dealers.ResponseDealer
+	// Handlers of extension frames by type
+	frameHandlers     map[parser.FrameType]api.FrameHandler
+	frameHandlersLock sync.RWMutex
+
+	// Hooks seeing every received and sent frame
+	tapsIn   []api.FrameHandler
+	tapsOut  []api.FrameHandler
+	tapsLock sync.RWMutex
+
+	// Dispatchers of incoming events and requests, and
+	// of responses to requests sent by this party
+	events    *dealers.EventDealer
+	requests  *dealers.RequestDealer
+	responses *dealers.ResponseDealer
 }
 
 //
@@ -52,49 +140,171 @@ type Connection struct {
 // transport.Connection and immediately starting read/write loop
 //
 func NewConnection(isClient bool, conn transport.Connection, bodyFormat format.BodyFormat) (*Connection, error) {
+	return NewConnectionWithOptions(isClient, conn, bodyFormat, Options{})
+}
+
+//
+// NewConnectionWithOptions Creates new instance of Connection
+// same as NewConnection but with non-default settings
+//
+func NewConnectionWithOptions(isClient bool, conn transport.Connection, bodyFormat format.BodyFormat, options Options) (*Connection, error) {
+
+	lanes := newLanes()
+	out := lanes[PRIORITY_NORMAL]
 
-	out := make(chan parser.Frame)
+	id := atomic.AddUint64(&connectionsCount, 1)
+	logger := logging.With(options.logger(), logging.F(logging.FIELD_CONNECTION, id))
+	m := metrics.New(metrics.Process)
 
 	connection := &Connection{
 
 		isClient:   isClient,
 		conn:       conn,
-		parser:     parser.NewParser(conn),
+		reader:     parser.NewReader(&metricsReader{conn, m}, options.limits()),
 		bodyFormat: bodyFormat,
+		options:    options,
+		id:         id,
+		logger:     logger,
+		metrics:    m,
+		pings:      make(map[string]chan error),
+
+		lanes:         lanes,
+		framesOut:     out,
+		frameHandlers: make(map[parser.FrameType]api.FrameHandler),
+
+		events:    dealers.NewEventDealer(bodyFormat),
+		requests:  dealers.NewRequestDealer(bodyFormat, out),
+		responses: dealers.NewResponseDealer(bodyFormat, out),
+	}
+
+	if options.EnableNoResponseError {
+		connection.requests.NoResponseError = connection.noResponseError
+	}
+
+	connection.events.Tracer = options.Tracer
+	connection.requests.Tracer = options.Tracer
+
+	connection.events.Logger = logger
+	connection.requests.Logger = logger
+	connection.responses.Logger = logger
+
+	connection.requests.IdGenerator = options.IdGenerator
+
+	connection.events.Ack = connection.ack
+
+	connection.events.Dedup = options.Dedup
+	connection.requests.Dedup = options.Dedup
+
+	connection.outbox = options.Outbox
+	if connection.outbox == nil {
+		connection.outbox = NewOutbox()
+	}
+
+	connection.responses.TTL = options.RequestTTL
+	connection.responses.MaxPending = options.MaxPendingRequests
+	connection.responses.IdGenerator = options.IdGenerator
+
+	connection.requests.OnFinish = connection.requestHandled
+
+	if options.OnStateChange != nil {
+		connection.OnStateChange(options.OnStateChange)
+	}
 
-		framesOut: out,
+	if options.OnFrameIn != nil {
+		connection.OnFrameIn(options.OnFrameIn)
+	}
+
+	if options.OnFrameOut != nil {
+		connection.OnFrameOut(options.OnFrameOut)
+	}
 
-		EventDealer:    dealers.NewEventDealer(bodyFormat),
-		RequestDealer:  dealers.NewRequestDealer(bodyFormat, out),
-		ResponseDealer: dealers.NewResponseDealer(bodyFormat),
+	if options.Debug != nil {
+		dumper := NewFrameDumper(options.Debug, bodyFormat)
+		connection.OnFrameIn(dumper.In)
+		connection.OnFrameOut(dumper.Out)
 	}
 
 	// Try handshake
 	if err := connection.handshake(); err != nil {
+		connection.responses.Abort(err)
 		return nil, err
 	}
 
 	return connection, nil
 }
 
+//
+// Id returns unique id of connection within process
+//
+func (c *Connection) Id() uint64 {
+	return c.id
+}
+
+//
+// Version returns protocol version negotiated in handshake
+//
+func (c *Connection) Version() uint16 {
+	return c.version
+}
+
+//
+// HasFeature indicates that protocol feature was negotiated in handshake
+//
+func (c *Connection) HasFeature(feature uint32) bool {
+	return c.features&feature != 0
+}
+
 //
 // Perform initial system.handshake
 //
 func (c *Connection) handshake() error {
 
+	var err error
 	if c.isClient {
-		if err := c.handshakeClient(); err != nil {
-			return err
-		}
+		err = c.handshakeClient()
 	} else {
-		if err := c.handshakeServer(); err != nil {
-			return err
-		}
+		err = c.handshakeServer()
+	}
+
+	if err != nil {
+		c.setState(STATE_CLOSED)
+		return err
 	}
 
+	// Frames after handshake are encoded as negotiated version
+	// defines, so parsing loop starts only now
+
+	c.reader.SetVersion(c.version)
+	c.reader.SetFeatures(c.features)
+	c.parser = parser.NewParserFromReader(c.reader)
+
+	// Apply negotiated features
+
+	if c.HasFeature(parser.FEATURE_FLOW_CONTROL) {
+		c.requests.FlowControl = true
+		c.requests.ChunkWindow = c.options.chunkWindow()
+		c.responses.ProgressWindow = c.options.progressWindow()
+	}
+
+	c.requests.Metadata = c.HasFeature(parser.FEATURE_METADATA)
+	c.requests.Version = c.version
+
+	c.setState(STATE_OPEN)
+
 	go c.readLoop()
 	go c.writeLoop()
 
+	if c.HasFeature(parser.FEATURE_EVENT_ACKS) {
+		c.outbox.attach(c)
+	}
+
+	// Replay doesn't hold up connection, frames
+	// are spooled in order meanwhile
+	if c.options.Spool != nil {
+		c.options.Spool.useGenerator(c.options.IdGenerator)
+		go c.options.Spool.attach(c)
+	}
+
 	return nil
 }
 
@@ -105,20 +315,33 @@ func (c *Connection) handshakeClient() error {
 
 	// Send system.handshake
 
-	(&parser.SystemHandshake{
-		Version: YAMP_VERSION,
-	}).Serialize(c.conn)
+	version := c.options.version()
+
+	c.writeDirect(&parser.SystemHandshake{
+		Version:  version,
+		Features: c.options.features(),
+	})
 
 	// Get response
 
-	frame, ok := <-c.parser.Frames
-	if !ok {
-		err := <-c.parser.Error
+	frame, err := c.readDirect()
+	if err != nil {
 		return err
 	}
 
 	// If got system.handshake back, then we're ok
+	// if server agreed on version we are able to speak
 	if frame.GetType() == parser.SYSTEM_HANDSHAKE {
+
+		handshake := frame.(*parser.SystemHandshake)
+		if handshake.Version > version || handshake.Version < YAMP_MIN_VERSION {
+			c.conn.Close()
+			return errors.New(fmt.Sprintf("Version not supported, server responded with version %d", handshake.Version))
+		}
+
+		c.version = handshake.Version
+		c.features = handshake.Features & c.options.features()
+
 		return nil
 	}
 
@@ -129,8 +352,7 @@ func (c *Connection) handshakeClient() error {
 
 	// Got unexpected message, close drop connection
 
-	c.conn.Close()
-	return errors.New("Unexpected event")
+	return c.rejectHandshake(frame)
 }
 
 //
@@ -140,56 +362,361 @@ func (c *Connection) handshakeServer() error {
 
 	// Wait for client to send system.handshake
 
-	frame, ok := <-c.parser.Frames
-	if !ok {
-		err := <-c.parser.Error
+	frame, err := c.readDirect()
+	if err != nil {
 		return err
 	}
 
 	// If client sent something else, close connection
 
 	if frame.GetType() != parser.SYSTEM_HANDSHAKE {
-		c.conn.Close()
-		return errors.New("Unexpected frame")
+		return c.rejectHandshake(frame)
 	}
 
-	// Check versions, and if we're satisfied
-	// respond with the same system.handshake
+	// Check versions, and if we're satisfied respond with
+	// system.handshake with highest version both parties support
+	// and features both parties support
 
 	handshake := frame.(*parser.SystemHandshake)
-	if handshake.Version != YAMP_VERSION {
-		c.closeWithCode(parser.CLOSE_VERSION_NOT_SUPPORTED, "")
+	if handshake.Version < YAMP_MIN_VERSION {
+		c.writeDirect(&parser.SystemClose{
+			Code: parser.CLOSE_VERSION_NOT_SUPPORTED,
+		})
+		c.conn.Close()
 		return errors.New(fmt.Sprintf("Version not supported, client was with version %d", handshake.Version))
 	}
 
-	frame.Serialize(c.conn)
+	c.version = c.options.version()
+	if handshake.Version < c.version {
+		c.version = handshake.Version
+	}
+
+	if c.version >= 2 {
+		c.features = handshake.Features & c.options.features()
+	}
+
+	c.writeDirect(&parser.SystemHandshake{
+		Version:  c.version,
+		Features: c.features,
+	})
+
+	return nil
+}
+
+//
+// Close connection because other party sent frame other
+// than handshake before handshake was done
+//
+func (c *Connection) rejectHandshake(frame parser.Frame) error {
+
+	err := &parser.ProtocolError{
+		Code:    parser.CLOSE_PROTOCOL_ERROR,
+		Message: fmt.Sprintf("Unexpected %s frame before handshake", frame.GetType()),
+	}
+
+	c.writeDirect(&parser.SystemClose{
+		Code:    err.Code,
+		Message: err.Message,
+	})
+	c.conn.Close()
+
+	return err
+}
+
+//
+// Check that event or request fits into frame of negotiated
+// protocol version and uses only negotiated features
+//
+func (c *Connection) checkSend(uri string, options *sendOptions) error {
+
+	if c.State() != STATE_OPEN {
+		return ErrClosed
+	}
+
+	if c.version < parser.VERSION_VARINT_LENGTHS && len(uri) > parser.LENGTH_UINT8.Max() {
+		return parser.ErrFieldTooLong
+	}
+
+	if len(options.header) > 0 && !c.HasFeature(parser.FEATURE_METADATA) {
+		return ErrNotNegotiated
+	}
+
+	if err := parser.CheckMetadata(c.version, options.header); err != nil {
+		return err
+	}
+
+	if !options.deadline.IsZero() && !time.Now().Before(options.deadline) {
+		return api.ErrDeadlineExceeded
+	}
+
+	return nil
+}
+
+//
+// Take slot of outstanding request. Waits for free one, but not
+// longer than deadline of request, unless options say to fail
+//
+func (c *Connection) reserve(options *sendOptions) error {
+
+	ctx := options.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if !options.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, options.deadline)
+		defer cancel()
+	}
+
+	return c.responses.Reserve(ctx, !c.options.FailOnPendingLimit && !options.noWait)
+}
+
+//
+// Register request as pending and take slot of outstanding request.
+// Fails if request with the same uid is pending already
+//
+func (c *Connection) register(uid uuid.UUID, options *sendOptions) error {
+
+	if err := c.responses.Claim(uid); err != nil {
+		return err
+	}
+
+	if err := c.reserve(options); err != nil {
+		c.responses.Unclaim(uid)
+		return err
+	}
 
 	return nil
 }
 
 //
-// Serializing loop
+// Start span of outgoing event or request and inject its context
+// into frame header. Returns nil if tracing is off
+//
+func (c *Connection) startSpan(kind trace.SpanKind, header *parser.UserHeader, options *sendOptions) *trace.Span {
+
+	if c.options.Tracer == nil {
+		return nil
+	}
+
+	parent, _ := trace.FromContext(options.ctx)
+
+	span := c.options.Tracer.StartSpan(header.Uri, kind, parent)
+	span.SetAttribute(trace.ATTRIBUTE_URI, header.Uri)
+	span.SetAttribute(trace.ATTRIBUTE_UID, uuid.UUID(header.Uid).String())
+
+	if c.HasFeature(parser.FEATURE_METADATA) {
+		header.Metadata = header.Metadata.With(trace.TRACEPARENT_HEADER, span.Context.Traceparent())
+	}
+
+	return span
+}
+
+//
+// Metadata headers of request, including its deadline if
+// it is set and metadata headers were negotiated
+//
+func (c *Connection) requestHeader(options *sendOptions) parser.Metadata {
+
+	if options.deadline.IsZero() || !c.HasFeature(parser.FEATURE_METADATA) {
+		return options.header
+	}
+
+	return options.header.WithTimeout(time.Until(options.deadline))
+}
+
+//
+// Error response to request that failed before it was sent
+//
+func (c *Connection) localError(request *parser.Request, err error) *api.Response {
+
+	body, _ := c.bodyFormat.Serialize(err.Error())
+
+	return &api.Response{
+		BodyFormat:   c.bodyFormat,
+		RequestFrame: request,
+		Frame: &parser.Response{
+			UserHeader: parser.UserHeader{
+				Uid: c.newId(),
+			},
+			RequestUid: request.Uid,
+			Type:       parser.RESPONSE_ERROR,
+			UserBody: parser.UserBody{
+				Body: body,
+			},
+		},
+	}
+}
+
+//
+// Body of automatic error response for unanswered request
+//
+func (c *Connection) noResponseError(req *api.Request) interface{} {
+
+	if c.options.NoResponseError != nil {
+		return c.options.NoResponseError
+	}
+
+	return DEFAULT_NO_RESPONSE_ERROR
+}
+
+//
+// Serializing loop. Frames are coalesced into batches flushed when
+// batch is full, when there are no more frames queued or when max
+// latency passed. Frames larger than fragment size are written
+// fragment by fragment, interleaved with frames of other lanes.
+// Lane of frame being fragmented is held until its last fragment
+// is written, so frames of one lane never overtake each other
 //
 func (c *Connection) writeLoop() {
 
+	batch := newWriteBatch(c.conn, c.options.writeBatchSize())
+	latency := c.options.WriteMaxLatency
+
+	fragmented := []*fragmenter{}
+
+	// Lanes having frame being fragmented
+	busy := make([]bool, len(c.lanes))
+
+	// Fires when oldest frame in batch waited for max latency
+	var deadline <-chan time.Time
+
 	for {
 
-		frame, ok := <-c.framesOut
+		// Don't wait if there are fragments to write or batch should be
+		// flushed as soon as queue is idle, otherwise wait for more
+		// frames, but not longer than latency allows
+		block := len(fragmented) == 0 && (batch.size == 0 || latency > 0)
+
+		var wait <-chan time.Time
+		if batch.size > 0 {
+			wait = deadline
+		}
+
+		// Lanes are busy only while there are fragments to write
+		var held []bool
+		if len(fragmented) > 0 {
+			held = busy
+		}
+
+		frame, priority, ok := c.nextFrame(block, wait, held)
 
 		if !ok {
+			batch.flush()
 			return
 		}
 
-		frame.Serialize(c.conn)
+		if marker, ok := frame.(*flushMarker); ok {
+			batch.flush()
+			marker.done <- batch.err
+			continue
+		}
+
+		if frame != nil {
+
+			if batch.size == 0 && latency > 0 {
+				deadline = time.After(latency)
+			}
+
+			if f := c.writeFrame(batch, frame); f != nil {
+				f.priority = priority
+				busy[priority] = true
+				fragmented = append(fragmented, f)
+			}
+
+			switch frame.GetType() {
+
+			// Nothing is expected to be sent after close frame
+			case parser.SYSTEM_CLOSE:
+				c.metrics.Close(frame.(*parser.SystemClose).Code.String(), false)
+				batch.flush()
+				c.conn.Close()
+
+			// Don't hold system frames in batch
+			case parser.SYSTEM_PING:
+				batch.flush()
+			}
+		}
+
+		// Write single fragment of the first fragmented frame
+		// and move it back of the queue
+
+		if len(fragmented) > 0 {
+
+			f := fragmented[0]
+			fragmented = fragmented[1:]
+
+			fragment, writer, last := f.next()
+			c.frameOut(fragment)
+			c.metrics.FrameOut(parser.FRAGMENT.String(), writer.Len())
+			batch.add(writer)
+
+			if last {
+				busy[f.priority] = false
+			} else {
+				fragmented = append(fragmented, f)
+			}
+		}
+
+		// Queue is idle or deadline passed
+		if frame == nil && len(fragmented) == 0 {
+			batch.flush()
+		}
 	}
 
 }
 
+//
+// Serialize frame and add it to batch, or return fragmenter if
+// frame is too large and fragmentation was negotiated
+//
+func (c *Connection) writeFrame(batch *writeBatch, frame parser.Frame) *fragmenter {
+
+	c.frameOut(frame)
+
+	writer := parser.AcquireWriter()
+	writer.SetVersion(c.version)
+	writer.SetFeatures(c.features)
+
+	if err := frame.Serialize(writer); err != nil {
+		c.logger.Log(logging.LEVEL_ERROR, "Unable to serialize frame",
+			logging.F(logging.FIELD_FRAME_TYPE, frame.GetType()),
+			logging.F(logging.FIELD_ERROR, err))
+		parser.ReleaseWriter(writer)
+
+		// Requester would wait for response forever otherwise. Handlers
+		// may send frames, so they don't run in write loop
+		switch request := frame.(type) {
+		case *parser.Request:
+			go c.responses.Fail(request.Uid, err)
+		case *parser.StreamRequest:
+			go c.responses.Fail(request.Uid, err)
+		}
+
+		return nil
+	}
+
+	c.metrics.FrameOut(frame.GetType().String(), writer.Len())
+
+	size := c.options.fragmentSize()
+
+	if c.HasFeature(parser.FEATURE_FRAGMENTATION) && writer.Len() > size {
+		return newFragmenter(writer, size, c.newId())
+	}
+
+	batch.add(writer)
+
+	return nil
+}
+
 //
 // Parsing loop
 //
 func (c *Connection) readLoop() {
 
+	reassembler := newReassembler(c.options.limits(), c.version, c.features)
+
 	for {
 
 		//
@@ -198,63 +725,160 @@ func (c *Connection) readLoop() {
 		frame, ok := <-c.parser.Frames
 
 		if !ok {
-			log.Println(<-c.parser.Error)
+			c.stop(<-c.parser.Error)
+			return
+		}
+
+		c.frameIn(frame)
+
+		if err := c.checkFrameIn(frame); err != nil {
+			c.stop(err)
 			return
 		}
 
 		//
-		// Dispatch new frame
+		// Collect fragments until whole frame is there
 		//
-		switch frame.GetType() {
+		if frame.GetType() == parser.FRAGMENT {
 
-		case parser.SYSTEM_CLOSE:
+			reassembled, err := reassembler.add(frame.(*parser.Fragment))
+			if err != nil {
+				c.stop(err)
+				return
+			}
 
-			close := frame.(*parser.SystemClose)
-			log.Println(close.Code, close.Message)
+			if reassembled == nil {
+				continue
+			}
 
-		case parser.SYSTEM_PING:
+			frame = reassembled
+			c.frameIn(frame)
+		}
 
-			ping := frame.(*parser.SystemPing)
+		c.dispatch(frame)
+	}
 
-			// TODO:got response on our ping request
-			// since we do not send it now, we don't need to
-			// handle it either
-			if ping.Ack {
-				continue
-			}
+}
 
-			// Respond with ping ack
-			c.framesOut <- &parser.SystemPing{
-				Ack:     true,
-				Payload: ping.Payload,
-			}
+//
+// Stop processing incoming frames because of error. Protocol
+// violations are reported to other party with close frame
+//
+func (c *Connection) stop(err error) {
+
+	if err == io.EOF {
+		c.logger.Log(logging.LEVEL_INFO, "Connection closed")
+	} else {
+		c.logger.Log(logging.LEVEL_ERROR, "Connection failed", logging.F(logging.FIELD_ERROR, err))
+	}
+
+	if protocolErr, ok := err.(*parser.ProtocolError); ok {
+		c.closeWithCode(protocolErr.Code, protocolErr.Message)
+	}
+
+	c.setState(STATE_CLOSED)
+	c.failPings(ErrClosed)
+	c.requests.Release()
+	c.responses.Abort(ErrClosed)
+	c.events.UnsubscribeAll()
+
+	if c.options.Spool != nil {
+		c.options.Spool.detach(c)
+	}
+
+	c.outbox.detach(c)
+	if c.outbox != c.options.Outbox {
+		c.outbox.abort(ErrClosed)
+	}
+}
+
+//
+// Dispatch new frame
+//
+func (c *Connection) dispatch(frame parser.Frame) {
 
-		case parser.EVENT:
-			c.EventDealer.In <- *(frame).(*parser.Event)
+	switch frame.GetType() {
 
-		case parser.RESPONSE:
-			c.ResponseDealer.In <- *(frame).(*parser.Response)
+	case parser.SYSTEM_CLOSE:
 
-		case parser.REQUEST:
-			c.RequestDealer.In <- *(frame).(*parser.Request)
+		close := frame.(*parser.SystemClose)
+		c.closeReceived = true
+		c.setState(STATE_CLOSING)
+		c.metrics.Close(close.Code.String(), true)
+		c.logger.Log(logging.LEVEL_INFO, "Connection closed by other party",
+			logging.F("code", close.Code),
+			logging.F("message", close.Message))
 
-		default:
-			log.Println("Unhandled frame", frame.GetType(), frame)
+	case parser.SYSTEM_PING:
 
+		ping := frame.(*parser.SystemPing)
+
+		// Got response on our ping request
+		if ping.Ack {
+			c.pingAck(ping)
+			return
 		}
 
-	}
+		// Respond with ping ack
+		c.lane(priority_system) <- &parser.SystemPing{
+			Ack:     true,
+			Payload: ping.Payload,
+		}
+
+	case parser.EVENT:
+		c.events.In <- *(frame).(*parser.Event)
+
+	case parser.ACKED_EVENT:
+		c.events.DispatchAcked(frame.(*parser.AckedEvent).Event)
+
+	case parser.ACK:
+		c.outbox.ack(frame.(*parser.Ack).EventUid)
+
+	case parser.RESPONSE:
+		c.responses.In <- *(frame).(*parser.Response)
+
+	case parser.REQUEST:
+		c.requests.In <- *(frame).(*parser.Request)
+
+	case parser.STREAM_REQUEST:
+		c.requests.Streams <- *(frame).(*parser.StreamRequest)
 
+	case parser.STREAM_CHUNK:
+		c.requests.Chunks <- *(frame).(*parser.StreamChunk)
+
+	// Credit is either for body chunks of own streaming
+	// request, or for progress responses of other party's one
+	case parser.CREDIT:
+		credit := *(frame).(*parser.Credit)
+		if !c.responses.Grant(credit) {
+			c.requests.Credits <- credit
+		}
+
+	default:
+		c.dispatchExtension(frame)
+
+	}
 }
 
+//
+// Send close frame, transport is closed once it is written
+//
 func (c *Connection) closeWithCode(code parser.CloseCode, message string) {
 
-	c.framesOut <- &parser.SystemClose{
+	// Close frame is sent only once
+	if !c.setState(STATE_CLOSING) {
+		return
+	}
+
+	// Older protocol versions have limited size of message
+	if max := parser.LENGTH_UINT16.Max(); c.version < parser.VERSION_VARINT_LENGTHS && len(message) > max {
+		message = message[:max]
+	}
+
+	c.lane(priority_system) <- &parser.SystemClose{
 		Code:    code,
 		Message: message,
 	}
-
-	c.conn.Close()
 }
 
 //
@@ -264,46 +888,405 @@ func (c *Connection) Close(message string) {
 	c.closeWithCode(parser.CLOSE_UNKNOWN, message)
 }
 
+//
+// OnEvent registers handler of events of uri
+//
+func (c *Connection) OnEvent(uri string, handler api.EventHandler) {
+	c.events.OnEvent(uri, handler)
+}
+
+//
+// Subscribe returns channel delivering events of uri in order they came,
+// buffering up to bufferSize of them. If consumer falls behind, delivery
+// of all incoming frames waits for it. Channel is closed on unsubscribe
+// or once connection is closed
+//
+func (c *Connection) Subscribe(uri string, bufferSize int) (<-chan *api.Event, *api.Subscription) {
+	return c.events.Subscribe(uri, bufferSize)
+}
+
+//
+// SubscribeWithOverflow is Subscribe with policy applied once buffer
+// is full. OVERFLOW_DROP_OLDEST needs bufferSize of at least one
+//
+func (c *Connection) SubscribeWithOverflow(uri string, bufferSize int, overflow api.Overflow) (<-chan *api.Event, *api.Subscription, error) {
+	return c.events.SubscribeWithOverflow(uri, bufferSize, overflow)
+}
+
+//
+// OnRequest registers handler of requests of uri
+//
+func (c *Connection) OnRequest(uri string, handler api.RequestHandler) error {
+	return c.requests.OnRequest(uri, handler)
+}
+
+//
+// OnResponse registers handler of responses to request with uid
+//
+func (c *Connection) OnResponse(uid uuid.UUID, handler api.ResponseHandler) error {
+	return c.responses.OnResponse(uid, handler)
+}
+
+//
+// PendingRequests returns requests waiting for terminal response, oldest first
+//
+func (c *Connection) PendingRequests() []dealers.PendingRequest {
+	return c.responses.PendingRequests()
+}
+
 //
 // SendEvent
 //
-func (c *Connection) SendEvent(uri string, body interface{}) {
+func (c *Connection) SendEvent(uri string, body interface{}, opts ...SendOption) error {
 
-	uid := uuid.NewV1()
+	options := newSendOptions(opts)
+
+	if err := c.checkSend(uri, options); err != nil {
+		return err
+	}
+
+	uid := c.uid(options)
 	b, _ := c.bodyFormat.Serialize(body)
 
 	event := parser.Event{
 		UserHeader: parser.UserHeader{
-			Uid: uid,
-			Uri: uri,
+			Uid:      uid,
+			Uri:      uri,
+			Metadata: options.header,
 		},
 		UserBody: parser.UserBody{
 			Body: b,
 		},
 	}
 
-	c.framesOut <- &event
+	span := c.startSpan(trace.SPAN_KIND_PRODUCER, &event.UserHeader, options)
+
+	c.lane(options.priority) <- &event
+
+	if span != nil {
+		span.Finish()
+	}
+
+	return nil
+}
+
+//
+// SendEventAcked sends event other party confirms once its handlers
+// returned. Event is retransmitted until it is confirmed or its deadline
+// passes, so other party may get it more than once. Returned delivery
+// reports the outcome. Both parties should support acked events
+//
+func (c *Connection) SendEventAcked(uri string, body interface{}, opts ...SendOption) *api.Delivery {
+
+	options := newSendOptions(opts)
+
+	if err := c.checkSend(uri, options); err != nil {
+		return failedDelivery(err)
+	}
+
+	if !c.HasFeature(parser.FEATURE_EVENT_ACKS) {
+		return failedDelivery(ErrNotNegotiated)
+	}
+
+	b, _ := c.bodyFormat.Serialize(body)
+
+	event := &parser.AckedEvent{
+		Event: parser.Event{
+			UserHeader: parser.UserHeader{
+				Uid:      c.uid(options),
+				Uri:      uri,
+				Metadata: options.header,
+			},
+			UserBody: parser.UserBody{
+				Body: b,
+			},
+		},
+	}
+
+	if span := c.startSpan(trace.SPAN_KIND_PRODUCER, &event.UserHeader, options); span != nil {
+		span.Finish()
+	}
+
+	return c.outbox.add(event, options)
+}
+
+//
+// Send ack of handled event
+//
+func (c *Connection) ack(uid uuid.UUID) {
+	c.framesOut <- &parser.Ack{EventUid: uid}
+}
+
+//
+// Delivery failed before event was sent
+//
+func failedDelivery(err error) *api.Delivery {
+	delivery := api.NewDelivery()
+	delivery.Resolve(err)
+	return delivery
 }
 
 //
 // SendRequest
 //
-func (c *Connection) SendRequest(uri string, body interface{}, handler api.ResponseHandler) {
+func (c *Connection) SendRequest(uri string, body interface{}, handler api.ResponseHandler, opts ...SendOption) error {
+
+	options := newSendOptions(opts)
+
+	if err := c.checkSend(uri, options); err != nil {
+		return err
+	}
+
+	request := c.newRequest(uri, body, options)
+
+	if err := c.register(request.Uid, options); err != nil {
+		return err
+	}
+
+	c.responses.OnResponse(request.Uid, handler)
+
+	c.sendRequest(request, &request.UserHeader, options)
+
+	return nil
+}
+
+//
+// Call sends request and returns stream delivering its
+// progress responses and terminal response in order.
+// If request can't be sent, stream gets error response
+//
+func (c *Connection) Call(uri string, body interface{}, opts ...SendOption) *api.ResponseStream {
+
+	options := newSendOptions(opts)
+
+	request := c.newRequest(uri, body, options)
+	stream := api.NewResponseStream()
+
+	if err := c.checkSend(uri, options); err != nil {
+		stream.Push(c.localError(request, err))
+		return stream
+	}
+
+	if err := c.register(request.Uid, options); err != nil {
+		stream.Push(c.localError(request, err))
+		return stream
+	}
+
+	c.responses.OnResponseStream(request.Uid, stream)
+
+	c.sendRequest(request, &request.UserHeader, options)
+
+	return stream
+}
+
+//
+// SendRequestAsync sends request and returns future of its terminal
+// response. Progress responses are dropped. If request can't be
+// sent, future gets error response
+//
+func (c *Connection) SendRequestAsync(uri string, body interface{}, opts ...SendOption) *api.Future {
+
+	options := newSendOptions(opts)
+
+	request := c.newRequest(uri, body, options)
+	future := api.NewFuture()
+
+	if err := c.checkSend(uri, options); err != nil {
+		future.Resolve(c.localError(request, err))
+		return future
+	}
+
+	if err := c.register(request.Uid, options); err != nil {
+		future.Resolve(c.localError(request, err))
+		return future
+	}
+
+	c.responses.OnResponse(request.Uid, future.Resolve)
+
+	c.sendRequest(request, &request.UserHeader, options)
+
+	return future
+}
+
+//
+// Send request frame followed by initial credit if flow control is on
+//
+func (c *Connection) sendRequest(request parser.Frame, header *parser.UserHeader, options *sendOptions) {
+
+	uid := header.Uid
+	uri := header.Uri
+
+	c.responses.Track(uid, uri, options.deadline)
+
+	span := c.startSpan(trace.SPAN_KIND_CLIENT, header, options)
+
+	c.metrics.RequestSent()
+
+	c.responses.Finally(uid, func(response *api.Response) {
+
+		c.metrics.RequestFinished(uri, response.Frame.Type.String())
+
+		if span != nil {
+			span.SetAttribute(trace.ATTRIBUTE_RESPONSE_TYPE, response.Frame.Type.String())
+			span.Finish()
+		}
+	})
+
+	lane := c.lane(options.priority)
+
+	lane <- request
+
+	if credit := c.responses.InitialCredit(uid); credit != nil {
+		lane <- credit
+	}
+}
+
+//
+// CallStream sends streaming request which body continues in chunks
+// written to returned RequestWriter, and returns stream of its responses.
+// Both parties should support request streaming
+//
+func (c *Connection) CallStream(uri string, body interface{}, opts ...SendOption) (*api.RequestWriter, *api.ResponseStream, error) {
+
+	if !c.HasFeature(parser.FEATURE_REQUEST_STREAMING) {
+		return nil, nil, ErrNotNegotiated
+	}
+
+	options := newSendOptions(opts)
+
+	if err := c.checkSend(uri, options); err != nil {
+		return nil, nil, err
+	}
+
+	request := c.newRequest(uri, body, options)
+
+	if err := c.register(request.Uid, options); err != nil {
+		return nil, nil, err
+	}
+
+	stream := api.NewResponseStream()
+
+	c.responses.OnResponseStream(request.Uid, stream)
+
+	// Window is there before responder grants credit
+	window := c.responses.StreamWindow(request.Uid)
+
+	frame := &parser.StreamRequest{Request: *request}
+	c.sendRequest(frame, &frame.UserHeader, options)
+
+	return &api.RequestWriter{
+		BodyFormat:   c.bodyFormat,
+		Out:          c.lane(options.priority),
+		RequestFrame: request,
+		IdGenerator:  c.options.IdGenerator,
+		Window:       window,
+	}, stream, nil
+}
+
+//
+// SendRequestStream sends streaming request which raw body is read
+// from reader chunk by chunk, so it is never buffered as a whole.
+// Returns when whole body is sent or reader failed
+//
+func (c *Connection) SendRequestStream(uri string, body io.Reader, handler api.ResponseHandler, opts ...SendOption) error {
+
+	if !c.HasFeature(parser.FEATURE_REQUEST_STREAMING) {
+		return ErrNotNegotiated
+	}
+
+	options := newSendOptions(opts)
+
+	if err := c.checkSend(uri, options); err != nil {
+		return err
+	}
+
+	request := &parser.Request{
+		UserHeader: parser.UserHeader{
+			Uid:      c.uid(options),
+			Uri:      uri,
+			Metadata: c.requestHeader(options),
+		},
+	}
+
+	if err := c.register(request.Uid, options); err != nil {
+		return err
+	}
+
+	c.responses.OnResponse(request.Uid, handler)
+
+	// Window is there before responder grants credit
+	window := c.responses.StreamWindow(request.Uid)
+
+	frame := &parser.StreamRequest{Request: *request}
+	c.sendRequest(frame, &frame.UserHeader, options)
+
+	writer := &api.RequestWriter{
+		BodyFormat:   c.bodyFormat,
+		Out:          c.lane(options.priority),
+		RequestFrame: request,
+		IdGenerator:  c.options.IdGenerator,
+		Window:       window,
+	}
+
+	chunk := make([]byte, c.options.chunkSize())
+
+	for {
+
+		n, err := body.Read(chunk)
+
+		if n > 0 {
+			// Request is finished already, no point to read more
+			if err := writer.WriteRaw(append([]byte{}, chunk[:n]...)); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return writer.Close()
+		}
+
+		// Responder must not take truncated body for whole one
+		if err != nil {
+			writer.Abort(err)
+			return err
+		}
+	}
+}
+
+//
+// Generate uid of frame
+//
+func (c *Connection) newId() uuid.UUID {
+	return ids.Generate(c.options.IdGenerator)
+}
+
+//
+// Uid of event or request, either supplied by caller or generated
+//
+func (c *Connection) uid(options *sendOptions) uuid.UUID {
+
+	if options.uid != nil {
+		return *options.uid
+	}
+
+	return c.newId()
+}
+
+//
+// Create request frame with new uid and serialized body
+//
+func (c *Connection) newRequest(uri string, body interface{}, options *sendOptions) *parser.Request {
 
-	uid := uuid.NewV1()
 	b, _ := c.bodyFormat.Serialize(body)
 
-	request := parser.Request{
+	return &parser.Request{
 		UserHeader: parser.UserHeader{
-			Uid: uid,
-			Uri: uri,
+			Uid:      c.uid(options),
+			Uri:      uri,
+			Metadata: c.requestHeader(options),
 		},
 		UserBody: parser.UserBody{
 			Body: b,
 		},
 	}
-
-	c.OnResponse(uid, handler)
-
-	c.framesOut <- &request
 }
@@ -0,0 +1,152 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package dealers
+
+import (
+	"github.com/satori/go.uuid"
+	"github.com/yyyar/yamp-go/parser"
+	"sync"
+	"time"
+)
+
+const (
+
+	// Max number of uids deduplication remembers by default
+	DEFAULT_DEDUP_SIZE = 10000
+)
+
+//
+// Dedup remembers uids of incoming events and requests seen within
+// time window, so their duplicates brought by retries and redelivery
+// are not handled again. Terminal responses of requests are kept to
+// be replayed for duplicates, including ones that come while original
+// is still being handled. Dedup may be shared by connections
+//
+type Dedup struct {
+	lock sync.Mutex
+
+	window time.Duration
+	size   int
+
+	// Seen uids, and the same in order they were seen. Uids
+	// before head are forgotten already, they are dropped
+	// from slice once they make up half of it
+	seen  map[uuid.UUID]*dedupEntry
+	order []uuid.UUID
+	head  int
+
+	// Duplicates waiting for terminal response of request being handled.
+	// Kept apart from seen, so pruning does not leave them unanswered
+	waiting map[uuid.UUID][]func(*parser.Response)
+}
+
+//
+// Seen uid
+//
+type dedupEntry struct {
+	time time.Time
+
+	// Handling of event or request finished
+	finished bool
+
+	// Terminal response of request
+	response *parser.Response
+}
+
+//
+// NewDedup creates dedup remembering uids for window, but not
+// more than size of them. Size defaults to DEFAULT_DEDUP_SIZE.
+// Window should be positive, otherwise uids are forgotten right
+// away and nothing is deduplicated
+//
+func NewDedup(window time.Duration, size int) *Dedup {
+
+	if size <= 0 {
+		size = DEFAULT_DEDUP_SIZE
+	}
+
+	return &Dedup{
+		window: window,
+		size:   size,
+		seen:   make(map[uuid.UUID]*dedupEntry),
+
+		waiting: make(map[uuid.UUID][]func(*parser.Response)),
+	}
+}
+
+//
+// Remember uid. Returns true if it was seen before, along with
+// indication that its handling finished and cached response. If it
+// is still being handled, wait is called with its terminal response
+// once there is one. Wait is nil for events
+//
+func (d *Dedup) begin(uid uuid.UUID, wait func(*parser.Response)) (bool, bool, *parser.Response) {
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	d.prune(now)
+
+	if entry, ok := d.seen[uid]; ok {
+		if !entry.finished && wait != nil {
+			d.waiting[uid] = append(d.waiting[uid], wait)
+		}
+		return true, entry.finished, entry.response
+	}
+
+	d.seen[uid] = &dedupEntry{time: now}
+	d.order = append(d.order, uid)
+
+	return false, false, nil
+}
+
+//
+// Mark handling of uid as finished with terminal response, nil for events
+//
+func (d *Dedup) finish(uid uuid.UUID, response *parser.Response) {
+
+	d.lock.Lock()
+
+	if entry, ok := d.seen[uid]; ok {
+		entry.finished = true
+		entry.response = response
+	}
+
+	waiting := d.waiting[uid]
+	delete(d.waiting, uid)
+
+	d.lock.Unlock()
+
+	if response == nil {
+		return
+	}
+
+	for _, wait := range waiting {
+		wait(response)
+	}
+}
+
+//
+// Forget uids seen before window or over size. Should be called under lock
+//
+func (d *Dedup) prune(now time.Time) {
+
+	for ; d.head < len(d.order); d.head++ {
+
+		entry := d.seen[d.order[d.head]]
+		if len(d.order)-d.head < d.size && now.Sub(entry.time) < d.window {
+			break
+		}
+
+		delete(d.seen, d.order[d.head])
+	}
+
+	if d.head > len(d.order)/2 {
+		n := copy(d.order, d.order[d.head:])
+		d.order = d.order[:n]
+		d.head = 0
+	}
+}
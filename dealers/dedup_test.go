@@ -0,0 +1,48 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package dealers
+
+import (
+	"github.com/satori/go.uuid"
+	"testing"
+	"time"
+)
+
+//
+// Test dedup remembers at most size uids and
+// order of seen ones doesn't grow past them
+//
+func TestDedupSize(t *testing.T) {
+
+	const (
+		SIZE = 10
+		N    = 1000
+	)
+
+	d := NewDedup(time.Minute, SIZE)
+
+	var uid uuid.UUID
+
+	for i := 0; i < N; i++ {
+
+		uid = uuid.UUID{byte(i >> 8), byte(i)}
+
+		if duplicate, _, _ := d.begin(uid, nil); duplicate {
+			t.Fatal("Expected new uid", i, "not to be duplicate")
+		}
+
+		if len(d.order) > 2*SIZE {
+			t.Fatal("Expected order to be compacted, got", len(d.order), "uids")
+		}
+	}
+
+	if len(d.seen) != SIZE || len(d.order)-d.head != SIZE {
+		t.Fatal("Expected latest uids to be remembered, got", len(d.seen), len(d.order)-d.head)
+	}
+
+	if duplicate, _, _ := d.begin(uid, nil); !duplicate {
+		t.Fatal("Expected latest uid to be duplicate")
+	}
+}
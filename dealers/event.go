@@ -5,10 +5,13 @@
 package dealers
 
 import (
+	"context"
+	"github.com/satori/go.uuid"
 	"github.com/yyyar/yamp-go/api"
 	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/logging"
 	"github.com/yyyar/yamp-go/parser"
-	"log"
+	"github.com/yyyar/yamp-go/trace"
 	"sync"
 )
 
@@ -21,6 +24,27 @@ type EventDealer struct {
 	bodyFormat format.BodyFormat
 	In         chan parser.Event
 	handlers   map[string][]api.EventHandler
+
+	// Channel subscriptions by uri
+	subscriptions map[string][]*api.Subscription
+
+	// Set once subscriptions are closed with connection
+	closed bool
+
+	// Uids of dispatched events that should be acked once handled
+	acks map[uuid.UUID]bool
+
+	// Sends ack of event. Called once all handlers of acked event returned
+	Ack func(uid uuid.UUID)
+
+	// Optional deduplication of events
+	Dedup *Dedup
+
+	// Optional tracer of handlers execution
+	Tracer *trace.Tracer
+
+	// Logger of dropped events
+	Logger logging.Logger
 }
 
 //
@@ -32,6 +56,10 @@ func NewEventDealer(bodyFormat format.BodyFormat) *EventDealer {
 		bodyFormat: bodyFormat,
 		In:         make(chan parser.Event),
 		handlers:   make(map[string][]api.EventHandler),
+		Logger:     logging.Default,
+
+		subscriptions: make(map[string][]*api.Subscription),
+		acks:          make(map[uuid.UUID]bool),
 	}
 
 	go e.Loop()
@@ -53,6 +81,110 @@ func (e *EventDealer) OnEvent(uri string, handler api.EventHandler) {
 	e.handlers[uri] = append(e.handlers[uri], handler)
 }
 
+//
+// Subscribe returns channel delivering events of uri in order they came,
+// buffering up to bufferSize of them. If consumer falls behind, delivery
+// of all incoming frames waits for it. Use SubscribeWithOverflow to drop
+// events instead
+//
+func (e *EventDealer) Subscribe(uri string, bufferSize int) (<-chan *api.Event, *api.Subscription) {
+	return e.subscribe(api.NewSubscription(uri, bufferSize, api.OVERFLOW_BLOCK))
+}
+
+//
+// SubscribeWithOverflow is Subscribe with policy applied once buffer
+// is full. OVERFLOW_DROP_OLDEST needs bufferSize of at least one
+//
+func (e *EventDealer) SubscribeWithOverflow(uri string, bufferSize int, overflow api.Overflow) (<-chan *api.Event, *api.Subscription, error) {
+
+	if bufferSize < 0 || bufferSize == 0 && overflow == api.OVERFLOW_DROP_OLDEST {
+		return nil, nil, api.ErrBufferSize
+	}
+
+	events, subscription := e.subscribe(api.NewSubscription(uri, bufferSize, overflow))
+	return events, subscription, nil
+}
+
+//
+// Add subscription. Once dealer is closed, it is unsubscribed right away
+//
+func (e *EventDealer) subscribe(subscription *api.Subscription) (<-chan *api.Event, *api.Subscription) {
+
+	subscription.OnUnsubscribe = func() {
+		e.unsubscribe(subscription)
+	}
+
+	e.Lock()
+
+	if e.closed {
+		e.Unlock()
+		subscription.Unsubscribe()
+		return subscription.Events(), subscription
+	}
+
+	e.subscriptions[subscription.Uri] = append(e.subscriptions[subscription.Uri], subscription)
+	e.Unlock()
+
+	return subscription.Events(), subscription
+}
+
+//
+// UnsubscribeAll closes all subscriptions, including ones made
+// later, so consumers ranging over their channels stop
+//
+func (e *EventDealer) UnsubscribeAll() {
+
+	e.Lock()
+
+	e.closed = true
+
+	subscriptions := []*api.Subscription{}
+	for _, s := range e.subscriptions {
+		subscriptions = append(subscriptions, s...)
+	}
+
+	e.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.Unsubscribe()
+	}
+}
+
+//
+// Remove subscription, so it gets no more events
+//
+func (e *EventDealer) unsubscribe(subscription *api.Subscription) {
+
+	e.Lock()
+	defer e.Unlock()
+
+	subscriptions := []*api.Subscription{}
+	for _, s := range e.subscriptions[subscription.Uri] {
+		if s != subscription {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+
+	if len(subscriptions) == 0 {
+		delete(e.subscriptions, subscription.Uri)
+	} else {
+		e.subscriptions[subscription.Uri] = subscriptions
+	}
+}
+
+//
+// DispatchAcked passes event that should be acked once
+// handled, in order with other events
+//
+func (e *EventDealer) DispatchAcked(event parser.Event) {
+
+	e.Lock()
+	e.acks[event.Uid] = true
+	e.Unlock()
+
+	e.In <- event
+}
+
 //
 // Loop
 //
@@ -69,19 +201,104 @@ func (e *EventDealer) Loop() {
 		e.RLock()
 
 		handlers, ok := e.handlers[event.Uri]
+		subscriptions := e.subscriptions[event.Uri]
 
-		if !ok {
-			log.Println("No handlers for event uri " + event.Uri)
+		e.RUnlock()
+
+		e.Lock()
+		acked := e.acks[event.Uid]
+		delete(e.acks, event.Uid)
+		e.Unlock()
+
+		// Duplicate of handled acked event is acked again, since
+		// previous ack might be lost. Otherwise original one acks
+		if e.Dedup != nil {
+			if duplicate, finished, _ := e.Dedup.begin(event.Uid, nil); duplicate {
+				e.Logger.Log(logging.LEVEL_DEBUG, "Dropped duplicate event",
+					logging.F(logging.FIELD_URI, event.Uri),
+					logging.F(logging.FIELD_UID, uuid.UUID(event.Uid).String()))
+				if acked && finished {
+					e.Ack(event.Uid)
+				}
+				continue
+			}
+		}
+
+		// Unhandled event is acked anyway, since retransmits won't help
+		if !ok && len(subscriptions) == 0 {
+			e.Logger.Log(logging.LEVEL_WARN, "No handlers for event",
+				logging.F(logging.FIELD_URI, event.Uri),
+				logging.F(logging.FIELD_UID, uuid.UUID(event.Uid).String()))
+			if e.Dedup != nil {
+				e.Dedup.finish(event.Uid, nil)
+			}
+			if acked {
+				e.Ack(event.Uid)
+			}
 			continue
 		}
 
+		var handled sync.WaitGroup
+		handled.Add(len(handlers))
+
 		for _, handler := range handlers {
-			go handler(&api.Event{
-				e.bodyFormat,
-				event,
-			})
+			go (func(handler api.EventHandler) {
+				defer handled.Done()
+				e.handle(handler, event)
+			})(handler)
 		}
 
-		e.RUnlock()
+		// Subscriptions are fed synchronously to preserve events order
+		for _, subscription := range subscriptions {
+			e.push(subscription, event)
+		}
+
+		if acked || e.Dedup != nil {
+			go (func(uid uuid.UUID) {
+				handled.Wait()
+				if e.Dedup != nil {
+					e.Dedup.finish(uid, nil)
+				}
+				if acked {
+					e.Ack(uid)
+				}
+			})(event.Uid)
+		}
+	}
+}
+
+//
+// Deliver event to subscription within its span
+//
+func (e *EventDealer) push(subscription *api.Subscription, event parser.Event) {
+
+	ctx, span := startSpan(context.Background(), e.Tracer, trace.SPAN_KIND_CONSUMER, event.UserHeader)
+
+	subscription.Push(&api.Event{
+		BodyFormat: e.bodyFormat,
+		Frame:      event,
+		Ctx:        ctx,
+	})
+
+	if span != nil {
+		span.Finish()
+	}
+}
+
+//
+// Run event handler within its span
+//
+func (e *EventDealer) handle(handler api.EventHandler, event parser.Event) {
+
+	ctx, span := startSpan(context.Background(), e.Tracer, trace.SPAN_KIND_CONSUMER, event.UserHeader)
+
+	handler(&api.Event{
+		BodyFormat: e.bodyFormat,
+		Frame:      event,
+		Ctx:        ctx,
+	})
+
+	if span != nil {
+		span.Finish()
 	}
 }
@@ -0,0 +1,182 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package dealers
+
+import (
+	"container/heap"
+	"github.com/satori/go.uuid"
+	"github.com/yyyar/yamp-go/api"
+	"time"
+)
+
+//
+// PendingRequest describes request waiting for terminal response
+//
+type PendingRequest struct {
+	Uid uuid.UUID
+	Uri string
+
+	// Time request was sent
+	Sent time.Time
+
+	// Time request expires with local error response, zero if never
+	Expires time.Time
+
+	// Responses are delivered to stream rather than handler
+	Stream bool
+}
+
+//
+// Entry of pending requests table
+//
+type pendingRequest struct {
+	PendingRequest
+
+	handler api.ResponseHandler
+	stream  *api.ResponseStream
+
+	// Called on terminal response before handler gets it
+	finally func(*api.Response)
+
+	// Consumed progress responses not yet granted back
+	consumed uint32
+
+	// Credit for body chunks of streaming request, nil if there is none
+	window *api.Window
+
+	// Request holds slot of limited outstanding requests
+	reserved bool
+
+	// Index in expiry queue, -1 if expiry is not scheduled
+	index int
+}
+
+//
+// Queue of scheduled expiries of pending requests, earliest first.
+// Entries know their index, so finished ones are removed right away
+//
+type expiryQueue []*pendingRequest
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].Expires.Before(q[j].Expires) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	entry := x.(*pendingRequest)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*q = old[:len(old)-1]
+	return entry
+}
+
+//
+// Schedule expiry of request and wake up sweeper if it
+// became the earliest one. Should be called under lock
+//
+func (p *ResponseDealer) schedule(entry *pendingRequest, expires time.Time) {
+
+	entry.Expires = expires
+
+	if entry.index >= 0 {
+		heap.Fix(&p.expiries, entry.index)
+	} else {
+		heap.Push(&p.expiries, entry)
+	}
+
+	if p.expiries[0] == entry {
+		select {
+		case p.wake <- true:
+		default:
+		}
+	}
+}
+
+//
+// Remove scheduled expiry of request. Should be called under lock
+//
+func (p *ResponseDealer) unschedule(entry *pendingRequest) {
+	if entry.index >= 0 {
+		heap.Remove(&p.expiries, entry.index)
+	}
+}
+
+//
+// Sweeper completes expired requests with local error response
+//
+func (p *ResponseDealer) sweep() {
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+
+		expired, next := p.expired(time.Now())
+
+		for _, entry := range expired {
+			p.complete(entry, p.localError(entry.Uid, entry.Uri, api.ErrDeadlineExceeded))
+		}
+
+		if len(expired) > 0 {
+			continue
+		}
+
+		var wait <-chan time.Time
+		if !next.IsZero() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(next))
+			wait = timer.C
+		}
+
+		select {
+		case <-p.done:
+			return
+		case <-p.wake:
+		case <-wait:
+		}
+	}
+}
+
+//
+// Remove requests expired by now from table and return them,
+// along with time of next expiry, zero if there is none
+//
+func (p *ResponseDealer) expired(now time.Time) ([]*pendingRequest, time.Time) {
+
+	p.Lock()
+	defer p.Unlock()
+
+	expired := []*pendingRequest{}
+
+	for len(p.expiries) > 0 {
+
+		entry := p.expiries[0]
+
+		if entry.Expires.After(now) {
+			return expired, entry.Expires
+		}
+
+		p.forget(entry.Uid)
+		expired = append(expired, entry)
+	}
+
+	return expired, time.Time{}
+}
@@ -5,12 +5,18 @@
 package dealers
 
 import (
+	"context"
 	"errors"
+	"github.com/satori/go.uuid"
 	"github.com/yyyar/yamp-go/api"
 	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/ids"
+	"github.com/yyyar/yamp-go/logging"
 	"github.com/yyyar/yamp-go/parser"
-	"log"
+	"github.com/yyyar/yamp-go/trace"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 //
@@ -21,8 +27,46 @@ type RequestDealer struct {
 
 	bodyFormat format.BodyFormat
 	In         chan parser.Request
+	Streams    chan parser.StreamRequest
+	Chunks     chan parser.StreamChunk
+	Credits    chan parser.Credit
 	out        chan parser.Frame
 	handlers   map[string]api.RequestHandler
+	windows    map[uuid.UUID]*api.Window
+	chunks     map[uuid.UUID]*api.ChunkStream
+
+	// Indicates that progress responses are flow controlled
+	FlowControl bool
+
+	// Credit granted to requester for body chunks of every
+	// streaming request. Zero means no flow control
+	ChunkWindow uint32
+
+	// Indicates that responses may carry metadata headers
+	Metadata bool
+
+	// Negotiated protocol version, limits length of metadata headers
+	Version uint16
+
+	// Generator of response uids. Defaults to ids.Default
+	IdGenerator ids.Generator
+
+	// Optional tracer of handlers execution
+	Tracer *trace.Tracer
+
+	// Optional callback called once request is finished with terminal response
+	OnFinish func(request *parser.Request, response *api.Response, latency time.Duration)
+
+	// Logger of dropped requests
+	Logger logging.Logger
+
+	// Optional deduplication of requests. Streaming requests
+	// are not deduplicated
+	Dedup *Dedup
+
+	// Returns body of error response that is sent when handler
+	// returned without terminal response. Nil disables it
+	NoResponseError func(*api.Request) interface{}
 }
 
 //
@@ -33,8 +77,14 @@ func NewRequestDealer(bodyFormat format.BodyFormat, out chan parser.Frame) *Requ
 	p := &RequestDealer{
 		bodyFormat: bodyFormat,
 		In:         make(chan parser.Request),
+		Streams:    make(chan parser.StreamRequest),
+		Chunks:     make(chan parser.StreamChunk),
+		Credits:    make(chan parser.Credit),
 		out:        out,
 		handlers:   make(map[string]api.RequestHandler),
+		windows:    make(map[uuid.UUID]*api.Window),
+		chunks:     make(map[uuid.UUID]*api.ChunkStream),
+		Logger:     logging.Default,
 	}
 
 	go p.Loop()
@@ -59,35 +109,266 @@ func (p *RequestDealer) OnRequest(uri string, handler api.RequestHandler) error
 
 }
 
+//
+// Release releases all responders waiting for credit or
+// request chunks, should be called when connection is gone
+//
+func (p *RequestDealer) Release() {
+
+	p.Lock()
+	defer p.Unlock()
+
+	for uid, window := range p.windows {
+		window.Close()
+		delete(p.windows, uid)
+	}
+
+	for uid, chunks := range p.chunks {
+		chunks.Abort(api.ErrClosed)
+		delete(p.chunks, uid)
+	}
+}
+
 //
 // Loop()
 //
 func (p *RequestDealer) Loop() {
 
+	// Requester sends credit and chunks after request, and since
+	// requests are dispatched synchronously, they find it registered
+
 	for {
 
-		request, ok := <-p.In
-		if !ok {
+		select {
+
+		case request, ok := <-p.In:
+			if !ok {
+				return
+			}
+			p.dispatch(request, nil)
+
+		case stream := <-p.Streams:
+			p.dispatch(stream.Request, api.NewChunkStream())
+
+		case chunk := <-p.Chunks:
+			p.RLock()
+			chunks, ok := p.chunks[chunk.RequestUid]
+			p.RUnlock()
+
+			if !ok {
+				continue
+			}
+
+			if chunk.Aborted {
+				chunks.Abort(api.ErrStreamAborted)
+			} else if chunk.End {
+				chunks.End()
+			} else {
+				chunks.Push(chunk.Body)
+			}
+
+		case credit := <-p.Credits:
+			p.RLock()
+			window, ok := p.windows[credit.RequestUid]
+			p.RUnlock()
+
+			if ok {
+				window.Grant(credit.Credit)
+			}
+		}
+	}
+}
+
+//
+// Find handler for request and run it. Chunks are
+// passed for streaming requests only
+//
+func (p *RequestDealer) dispatch(request parser.Request, chunks *api.ChunkStream) {
+
+	p.RLock()
+	handler, ok := p.handlers[request.Uri]
+	p.RUnlock()
+
+	if !ok {
+		p.Logger.Log(logging.LEVEL_WARN, "No handlers for request",
+			logging.F(logging.FIELD_URI, request.Uri),
+			logging.F(logging.FIELD_UID, uuid.UUID(request.Uid).String()))
+
+		// Requester of stream would keep sending body otherwise
+		if chunks != nil || p.NoResponseError != nil {
+			p.reject(&request, api.ErrNoHandler)
+		}
+
+		return
+	}
+
+	// Requester gave up on expired request already
+
+	ctx, cancel := requestContext(request)
+
+	if ctx.Err() != nil {
+		cancel()
+		p.Logger.Log(logging.LEVEL_INFO, "Dropped expired request",
+			logging.F(logging.FIELD_URI, request.Uri),
+			logging.F(logging.FIELD_UID, uuid.UUID(request.Uid).String()))
+		return
+	}
+
+	// Duplicate gets response of original request, right away if
+	// there is one already, or once original is finished
+
+	dedup := p.Dedup
+	if chunks != nil {
+		dedup = nil
+	}
+
+	if dedup != nil {
+		wait := func(response *parser.Response) {
+			p.out <- response
+		}
+		if duplicate, _, response := dedup.begin(request.Uid, wait); duplicate {
+			cancel()
+			p.Logger.Log(logging.LEVEL_DEBUG, "Dropped duplicate request",
+				logging.F(logging.FIELD_URI, request.Uri),
+				logging.F(logging.FIELD_UID, uuid.UUID(request.Uid).String()))
+			if response != nil {
+				p.out <- response
+			}
 			return
 		}
+	}
+
+	ctx, span := startSpan(ctx, p.Tracer, trace.SPAN_KIND_SERVER, request.UserHeader)
+	start := time.Now()
+
+	response := &api.Response{
+		BodyFormat:   p.bodyFormat,
+		Out:          p.out,
+		RequestFrame: &request,
+		AllowHeader:  p.Metadata,
+		Version:      p.Version,
+		IdGenerator:  p.IdGenerator,
+	}
+
+	response.OnFinish = func() {
+
+		p.Lock()
+		delete(p.windows, request.Uid)
+		delete(p.chunks, request.Uid)
+		p.Unlock()
+
+		cancel()
+
+		if dedup != nil {
+			dedup.finish(request.Uid, response.Frame)
+		}
+
+		if p.OnFinish != nil {
+			p.OnFinish(&request, response, time.Since(start))
+		}
+
+		if span != nil {
+			span.SetAttribute(trace.ATTRIBUTE_RESPONSE_TYPE, response.Frame.Type.String())
+			span.Finish()
+		}
+	}
+
+	if p.FlowControl {
+		response.Window = api.NewWindow()
+	}
+
+	p.Lock()
+	if response.Window != nil {
+		p.windows[request.Uid] = response.Window
+	}
+	if chunks != nil {
+		p.chunks[request.Uid] = chunks
+	}
+	p.Unlock()
+
+	if chunks != nil && p.ChunkWindow > 0 {
+		p.grantChunks(request.Uid, chunks)
+	}
+
+	go p.handle(handler, &api.Request{
+		BodyFormat: p.bodyFormat,
+		Frame:      request,
+		Chunks:     chunks,
+		Ctx:        ctx,
+	}, response)
+}
+
+//
+// Grant requester initial credit for body chunks of streaming
+// request, and credit back once half of window is consumed
+//
+func (p *RequestDealer) grantChunks(uid uuid.UUID, chunks *api.ChunkStream) {
+
+	threshold := p.ChunkWindow / 2
+	if threshold == 0 {
+		threshold = 1
+	}
 
-		p.RLock()
-		handler, ok := p.handlers[request.Uri]
-		p.RUnlock()
+	var consumed uint32
 
-		if !ok {
-			log.Println("No handlers for request uri " + request.Uri)
-			continue
+	chunks.OnNext = func() {
+		if atomic.AddUint32(&consumed, 1)%threshold == 0 {
+			p.out <- &parser.Credit{
+				RequestUid: uid,
+				Credit:     threshold,
+			}
 		}
+	}
+
+	p.out <- &parser.Credit{
+		RequestUid: uid,
+		Credit:     p.ChunkWindow,
+	}
+}
+
+//
+// Create context of request, with deadline if requester set it
+//
+func requestContext(request parser.Request) (context.Context, context.CancelFunc) {
+
+	if timeout, ok := request.Metadata.Timeout(); ok {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+//
+// Respond to request that is not handled with error
+//
+func (p *RequestDealer) reject(request *parser.Request, err error) {
 
-		go handler(&api.Request{
-			p.bodyFormat,
-			request,
-		}, &api.Response{
-			p.bodyFormat,
-			p.out,
-			&request,
-			nil,
-		})
+	response := &api.Response{
+		BodyFormat:   p.bodyFormat,
+		Out:          p.out,
+		RequestFrame: request,
+		IdGenerator:  p.IdGenerator,
 	}
+
+	response.Error(err.Error())
+}
+
+//
+// Run handler and respond with error if it did not respond itself
+//
+func (p *RequestDealer) handle(handler api.RequestHandler, req *api.Request, res *api.Response) {
+
+	handler(req, res)
+
+	if p.NoResponseError == nil || res.IsFinished() {
+		return
+	}
+
+	// Handler gave up because requester did
+	if req.Context().Err() == context.DeadlineExceeded {
+		res.Error(api.ErrDeadlineExceeded.Error())
+		return
+	}
+
+	res.Error(p.NoResponseError(req))
 }
@@ -5,12 +5,16 @@
 package dealers
 
 import (
+	"context"
 	"github.com/satori/go.uuid"
 	"github.com/yyyar/yamp-go/api"
 	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/ids"
+	"github.com/yyyar/yamp-go/logging"
 	"github.com/yyyar/yamp-go/parser"
-	"log"
+	"sort"
 	"sync"
+	"time"
 )
 
 //
@@ -21,21 +25,57 @@ type ResponseDealer struct {
 
 	bodyFormat format.BodyFormat
 	In         chan parser.Response
-	handlers   map[uuid.UUID]api.ResponseHandler
+	out        chan parser.Frame
+
+	// Requests waiting for terminal response
+	pending map[uuid.UUID]*pendingRequest
+
+	// Scheduled expiries of pending requests and sweeper wake up signal
+	expiries expiryQueue
+	wake     chan bool
+
+	// Slots of outstanding requests, nil if they are not limited
+	slots chan bool
+
+	// Closed once dealer is released
+	done chan bool
+
+	// Logger of dropped responses
+	Logger logging.Logger
+
+	// Generator of uids of locally created responses. Defaults to ids.Default
+	IdGenerator ids.Generator
+
+	// Credit granted to responder for progress responses
+	// of every request. Zero means no flow control
+	ProgressWindow uint32
+
+	// Time request without deadline waits for terminal response
+	// before it expires. Zero means forever
+	TTL time.Duration
+
+	// Max number of outstanding requests. Zero means no limit
+	MaxPending int
 }
 
 //
 // NewResponseDealer
 //
-func NewResponseDealer(bodyFormat format.BodyFormat) *ResponseDealer {
+func NewResponseDealer(bodyFormat format.BodyFormat, out chan parser.Frame) *ResponseDealer {
 
 	p := &ResponseDealer{
 		bodyFormat: bodyFormat,
 		In:         make(chan parser.Response),
-		handlers:   make(map[uuid.UUID]api.ResponseHandler),
+		out:        out,
+		pending:    make(map[uuid.UUID]*pendingRequest),
+		wake:       make(chan bool, 1),
+		done:       make(chan bool),
+		Logger:     logging.Default,
 	}
 
 	go p.Loop()
+	go p.sweep()
+
 	return p
 }
 
@@ -47,12 +87,394 @@ func (p *ResponseDealer) OnResponse(uid uuid.UUID, handler api.ResponseHandler)
 	p.Lock()
 	defer p.Unlock()
 
-	p.handlers[uid] = handler
+	p.entry(uid).handler = handler
 
 	return nil
 
 }
 
+//
+// OnResponseStream registers stream that will receive
+// all responses of request in order
+//
+func (p *ResponseDealer) OnResponseStream(uid uuid.UUID, stream *api.ResponseStream) error {
+
+	p.Lock()
+	defer p.Unlock()
+
+	entry := p.entry(uid)
+	entry.stream = stream
+	entry.Stream = true
+
+	stream.OnNext = func(response *api.Response) {
+		if response.IsProgress() {
+			p.consume(uid)
+		}
+	}
+
+	return nil
+}
+
+//
+// Claim registers request as pending before it is sent, so uid is not
+// reused meanwhile. Fails with api.ErrDuplicateUid if request with the
+// same uid is pending already
+//
+func (p *ResponseDealer) Claim(uid uuid.UUID) error {
+
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.pending[uid]; ok {
+		return api.ErrDuplicateUid
+	}
+
+	p.entry(uid)
+
+	return nil
+}
+
+//
+// Unclaim removes claimed request that was not sent after all
+//
+func (p *ResponseDealer) Unclaim(uid uuid.UUID) {
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.forget(uid)
+}
+
+//
+// Get or create entry of pending request. Should be called under lock
+//
+func (p *ResponseDealer) entry(uid uuid.UUID) *pendingRequest {
+
+	entry, ok := p.pending[uid]
+	if !ok {
+		entry = &pendingRequest{
+			PendingRequest: PendingRequest{Uid: uid, Sent: time.Now()},
+			index:          -1,
+		}
+		p.pending[uid] = entry
+	}
+
+	return entry
+}
+
+//
+// Finally registers callback called on terminal response of request,
+// including local one, before response handler gets it
+//
+func (p *ResponseDealer) Finally(uid uuid.UUID, callback func(*api.Response)) {
+
+	p.Lock()
+	defer p.Unlock()
+
+	if entry, ok := p.pending[uid]; ok {
+		entry.finally = callback
+	}
+}
+
+//
+// Reserve takes slot of outstanding request, waiting for one to be
+// freed until ctx is done, or failing with api.ErrTooManyPending
+// at once if wait is false. Slot is freed once request passed
+// to Track is finished
+//
+func (p *ResponseDealer) Reserve(ctx context.Context, wait bool) error {
+
+	if p.MaxPending <= 0 {
+		return nil
+	}
+
+	p.Lock()
+	if p.slots == nil {
+		p.slots = make(chan bool, p.MaxPending)
+	}
+	slots := p.slots
+	p.Unlock()
+
+	select {
+	case slots <- true:
+		return nil
+	default:
+	}
+
+	if !wait {
+		return api.ErrTooManyPending
+	}
+
+	select {
+	case slots <- true:
+		return nil
+	case <-p.done:
+		return api.ErrClosed
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return api.ErrDeadlineExceeded
+		}
+		return ctx.Err()
+	}
+}
+
+//
+// Track marks registered request as sent, holding slot taken with Reserve.
+// Request expires at deadline, or after TTL if deadline is zero
+//
+func (p *ResponseDealer) Track(uid uuid.UUID, uri string, deadline time.Time) {
+
+	p.Lock()
+	defer p.Unlock()
+
+	entry, ok := p.pending[uid]
+	if !ok {
+		if p.MaxPending > 0 {
+			<-p.slots
+		}
+		return
+	}
+
+	entry.Uri = uri
+	entry.Sent = time.Now()
+	entry.reserved = p.MaxPending > 0
+
+	if deadline.IsZero() && p.TTL > 0 {
+		deadline = entry.Sent.Add(p.TTL)
+	}
+
+	if !deadline.IsZero() {
+		p.schedule(entry, deadline)
+	}
+}
+
+//
+// PendingRequests returns requests waiting for terminal response, oldest first
+//
+func (p *ResponseDealer) PendingRequests() []PendingRequest {
+
+	p.RLock()
+	defer p.RUnlock()
+
+	result := make([]PendingRequest, 0, len(p.pending))
+	for _, entry := range p.pending {
+		result = append(result, entry.PendingRequest)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Sent.Before(result[j].Sent)
+	})
+
+	return result
+}
+
+//
+// Abort completes all pending requests with local error response
+// and stops sweeper, should be called when connection is gone
+//
+func (p *ResponseDealer) Abort(err error) {
+
+	p.Lock()
+
+	select {
+	case <-p.done:
+		p.Unlock()
+		return
+	default:
+		close(p.done)
+	}
+
+	entries := make([]*pendingRequest, 0, len(p.pending))
+	for uid, entry := range p.pending {
+		entries = append(entries, entry)
+		p.forget(uid)
+	}
+
+	p.Unlock()
+
+	for _, entry := range entries {
+		p.complete(entry, p.localError(entry.Uid, entry.Uri, err))
+	}
+}
+
+//
+// Fail completes pending request with local error response
+//
+func (p *ResponseDealer) Fail(uid uuid.UUID, err error) {
+
+	p.Lock()
+	entry, ok := p.pending[uid]
+	if ok {
+		p.forget(uid)
+	}
+	p.Unlock()
+
+	if ok {
+		p.complete(entry, p.localError(entry.Uid, entry.Uri, err))
+	}
+}
+
+//
+// Remove all state of finished request. Should be called under lock
+//
+func (p *ResponseDealer) forget(uid uuid.UUID) {
+
+	entry, ok := p.pending[uid]
+	if !ok {
+		return
+	}
+
+	delete(p.pending, uid)
+	p.unschedule(entry)
+
+	if entry.reserved {
+		<-p.slots
+	}
+
+	if entry.window != nil {
+		entry.window.Close()
+	}
+}
+
+//
+// Deliver terminal response to request already removed from table
+//
+func (p *ResponseDealer) complete(entry *pendingRequest, response *api.Response) {
+
+	if entry.finally != nil {
+		entry.finally(response)
+	}
+
+	if entry.stream != nil {
+		entry.stream.Push(response)
+	} else if entry.handler != nil {
+		entry.handler(response)
+	}
+}
+
+//
+// Error response to request created locally
+//
+func (p *ResponseDealer) localError(uid uuid.UUID, uri string, err error) *api.Response {
+
+	body, _ := p.bodyFormat.Serialize(err.Error())
+
+	return &api.Response{
+		BodyFormat: p.bodyFormat,
+		Frame: &parser.Response{
+			UserHeader: parser.UserHeader{
+				Uid: ids.Generate(p.IdGenerator),
+				Uri: uri,
+			},
+			RequestUid: uid,
+			Type:       parser.RESPONSE_ERROR,
+			UserBody: parser.UserBody{
+				Body: body,
+			},
+		},
+	}
+}
+
+//
+// StreamWindow registers window of credit responder grants for body
+// chunks of streaming request, or returns nil if flow control is off.
+// Window is closed once request is finished
+//
+func (p *ResponseDealer) StreamWindow(uid uuid.UUID) *api.Window {
+
+	if p.ProgressWindow == 0 {
+		return nil
+	}
+
+	window := api.NewWindow()
+
+	p.Lock()
+	defer p.Unlock()
+
+	if entry, ok := p.pending[uid]; ok {
+		entry.window = window
+	} else {
+		window.Close()
+	}
+
+	return window
+}
+
+//
+// Grant adds credit to window of streaming request. Returns
+// false if credit is not for body chunks of pending request
+//
+func (p *ResponseDealer) Grant(credit parser.Credit) bool {
+
+	p.RLock()
+	entry, ok := p.pending[credit.RequestUid]
+	p.RUnlock()
+
+	if !ok || entry.window == nil {
+		return false
+	}
+
+	entry.window.Grant(credit.Credit)
+
+	return true
+}
+
+//
+// InitialCredit returns credit frame that should be sent
+// right after request, or nil if flow control is off
+//
+func (p *ResponseDealer) InitialCredit(uid uuid.UUID) *parser.Credit {
+
+	if p.ProgressWindow == 0 {
+		return nil
+	}
+
+	return &parser.Credit{
+		RequestUid: uid,
+		Credit:     p.ProgressWindow,
+	}
+}
+
+//
+// Account consumed progress response and grant
+// credit back once half of window is consumed
+//
+func (p *ResponseDealer) consume(uid uuid.UUID) {
+
+	if p.ProgressWindow == 0 {
+		return
+	}
+
+	threshold := p.ProgressWindow / 2
+	if threshold == 0 {
+		threshold = 1
+	}
+
+	p.Lock()
+
+	entry, ok := p.pending[uid]
+	if !ok {
+		p.Unlock()
+		return
+	}
+
+	entry.consumed++
+	consumed := entry.consumed
+
+	if consumed < threshold {
+		p.Unlock()
+		return
+	}
+
+	entry.consumed = 0
+	p.Unlock()
+
+	p.out <- &parser.Credit{
+		RequestUid: uid,
+		Credit:     consumed,
+	}
+}
+
 //
 // Loop
 //
@@ -65,22 +487,49 @@ func (p *ResponseDealer) Loop() {
 			return
 		}
 
-		p.RLock()
-		handler, ok := p.handlers[response.RequestUid]
-		p.RUnlock()
+		p.Lock()
+		entry, ok := p.pending[response.RequestUid]
+		if ok && response.Type != parser.RESPONSE_PROGRESS {
+			p.forget(response.RequestUid)
+		}
+		p.Unlock()
 
 		if !ok {
-			log.Println("No handlers for response uri ", response.RequestUid)
+			p.Logger.Log(logging.LEVEL_WARN, "No handlers for response",
+				logging.F(logging.FIELD_URI, response.Uri),
+				logging.F(logging.FIELD_UID, uuid.UUID(response.RequestUid).String()))
+			continue
+		}
+
+		res := &api.Response{BodyFormat: p.bodyFormat, Frame: &response}
+
+		if response.Type != parser.RESPONSE_PROGRESS && entry.finally != nil {
+			entry.finally(res)
+		}
+
+		// Streams are fed synchronously to preserve responses order
+		if entry.stream != nil {
+			entry.stream.Push(res)
 			continue
 		}
 
-		if response.Type != parser.RESPONSE_PROGRESS {
-			p.Lock()
-			delete(p.handlers, response.RequestUid)
-			p.Unlock()
+		if entry.handler == nil {
+			continue
 		}
 
 		// TODO: possible problem
-		go handler(&api.Response{p.bodyFormat, nil, nil, &response})
+		go p.handle(entry.handler, res)
+	}
+}
+
+//
+// Run response handler and account consumed progress response
+//
+func (p *ResponseDealer) handle(handler api.ResponseHandler, response *api.Response) {
+
+	handler(response)
+
+	if response.IsProgress() {
+		p.consume(response.Frame.RequestUid)
 	}
 }
@@ -0,0 +1,69 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package dealers
+
+import (
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/ids"
+	"github.com/yyyar/yamp-go/parser"
+	"testing"
+	"time"
+)
+
+//
+// Test expiries of requests that got terminal response
+// don't stay in sweeper queue until they are due
+//
+func TestExpiriesOfFinished(t *testing.T) {
+
+	const N = 100
+
+	p := NewResponseDealer(&format.JsonBodyFormat{}, make(chan parser.Frame, N))
+	defer p.Abort(api.ErrClosed)
+
+	p.TTL = time.Hour
+
+	finished := make(chan bool, N)
+
+	for i := 0; i < N; i++ {
+
+		uid := ids.Generate(nil)
+
+		p.Claim(uid)
+		p.OnResponse(uid, func(*api.Response) {
+			finished <- true
+		})
+		p.Track(uid, "foo", time.Time{})
+
+		// Rescheduling keeps single entry
+		if i == 0 {
+			p.Lock()
+			p.schedule(p.pending[uid], time.Now().Add(time.Minute))
+			p.Unlock()
+		}
+
+		if i%2 == 0 {
+			p.In <- parser.Response{RequestUid: uid, Type: parser.RESPONSE_DONE}
+		}
+	}
+
+	for i := 0; i < N/2; i++ {
+		<-finished
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.expiries) != N/2 || len(p.pending) != N/2 {
+		t.Fatal("Expected expiries of finished requests to be removed, got", len(p.expiries), "for", len(p.pending), "pending")
+	}
+
+	for i, entry := range p.expiries {
+		if entry.index != i {
+			t.Fatal("Expected entry to know its index", i, "got", entry.index)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package dealers
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"github.com/yyyar/yamp-go/parser"
+	"github.com/yyyar/yamp-go/trace"
+)
+
+//
+// Start span of handling incoming frame, continuing trace of other
+// party if it sent traceparent. Returns nil span if tracer is nil
+//
+func startSpan(ctx context.Context, tracer *trace.Tracer, kind trace.SpanKind, header parser.UserHeader) (context.Context, *trace.Span) {
+
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	parent, _ := trace.ParseTraceparent(header.Metadata.Get(trace.TRACEPARENT_HEADER))
+
+	span := tracer.StartSpan(header.Uri, kind, parent)
+	span.SetAttribute(trace.ATTRIBUTE_URI, header.Uri)
+	span.SetAttribute(trace.ATTRIBUTE_UID, uuid.UUID(header.Uid).String())
+
+	return trace.NewContext(ctx, span.Context), span
+}
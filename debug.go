@@ -0,0 +1,229 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/ids"
+	"github.com/yyyar/yamp-go/parser"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Start of UUID v1 timestamps, 1582-10-15, in unix nanoseconds / 100
+//
+const uuidEpochOffset = 122192928000000000
+
+//
+// FrameDumper pretty prints frames for wire debugging, one per line,
+// with decoded uids and bodies rendered by body format. Its In and Out
+// methods are meant to be used as Connection.OnFrameIn and Connection.OnFrameOut hooks
+//
+type FrameDumper struct {
+	writer     io.Writer
+	bodyFormat format.BodyFormat
+	lock       sync.Mutex
+}
+
+//
+// NewFrameDumper creates dumper writing to writer. Bodies are
+// printed raw if bodyFormat is nil or unable to parse them
+//
+func NewFrameDumper(writer io.Writer, bodyFormat format.BodyFormat) *FrameDumper {
+	return &FrameDumper{
+		writer:     writer,
+		bodyFormat: bodyFormat,
+	}
+}
+
+//
+// In prints received frame
+//
+func (d *FrameDumper) In(frame parser.Frame) {
+	d.dump("<", frame)
+}
+
+//
+// Out prints sent frame
+//
+func (d *FrameDumper) Out(frame parser.Frame) {
+	d.dump(">", frame)
+}
+
+func (d *FrameDumper) dump(direction string, frame parser.Frame) {
+
+	line := direction + " " + FormatFrame(frame, d.bodyFormat) + "\n"
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.writer.Write([]byte(line))
+}
+
+//
+// FormatFrame renders frame as single human readable line
+//
+func FormatFrame(frame parser.Frame, bodyFormat format.BodyFormat) string {
+
+	var b bytes.Buffer
+	b.WriteString(frame.GetType().String())
+
+	field := func(name string, value interface{}) {
+		fmt.Fprintf(&b, " %s=%v", name, value)
+	}
+
+	header := func(h parser.UserHeader) {
+		field("uid", FormatUid(h.Uid))
+		field("uri", fmt.Sprintf("%q", h.Uri))
+		if len(h.Metadata) > 0 {
+			field("header", formatMetadata(h.Metadata))
+		}
+	}
+
+	body := func(body parser.UserBody) {
+		field("body", formatBody(body.Body, bodyFormat))
+	}
+
+	switch f := frame.(type) {
+
+	case *parser.SystemHandshake:
+		field("version", f.Version)
+		field("features", fmt.Sprintf("0x%x", f.Features))
+
+	case *parser.SystemPing:
+		field("ack", f.Ack)
+		field("payload", fmt.Sprintf("%q", f.Payload))
+
+	case *parser.SystemClose:
+		field("code", f.Code)
+		field("message", fmt.Sprintf("%q", f.Message))
+
+	case *parser.Event:
+		header(f.UserHeader)
+		body(f.UserBody)
+
+	case *parser.AckedEvent:
+		header(f.UserHeader)
+		body(f.UserBody)
+
+	case *parser.Ack:
+		field("event_uid", FormatUid(f.EventUid))
+
+	case *parser.Request:
+		header(f.UserHeader)
+		body(f.UserBody)
+
+	case *parser.StreamRequest:
+		header(f.UserHeader)
+		body(f.UserBody)
+
+	case *parser.StreamChunk:
+		header(f.UserHeader)
+		field("request_uid", FormatUid(f.RequestUid))
+		field("end", f.End)
+		if f.Aborted {
+			field("aborted", true)
+		}
+		body(f.UserBody)
+
+	case *parser.Response:
+		header(f.UserHeader)
+		field("request_uid", FormatUid(f.RequestUid))
+		field("type", f.Type)
+		body(f.UserBody)
+
+	case *parser.Cancel:
+		header(f.UserHeader)
+		field("request_uid", FormatUid(f.RequestUid))
+
+	case *parser.Credit:
+		field("request_uid", FormatUid(f.RequestUid))
+		field("credit", f.Credit)
+
+	case *parser.Fragment:
+		field("frame_uid", FormatUid(f.FrameUid))
+		field("last", f.Last)
+		field("size", len(f.Data))
+
+	default:
+		fmt.Fprintf(&b, " %+v", frame)
+	}
+
+	return b.String()
+}
+
+//
+// FormatUid renders uid as canonical string with version, followed by
+// generation time for time based uids
+//
+func FormatUid(uid [16]byte) string {
+
+	u := uuid.UUID(uid)
+	s := fmt.Sprintf("%s(v%d", u, u.Version())
+
+	if u.Version() == uuid.V1 {
+		low := uint64(binary.BigEndian.Uint32(uid[0:4]))
+		mid := uint64(binary.BigEndian.Uint16(uid[4:6]))
+		high := uint64(binary.BigEndian.Uint16(uid[6:8]) & 0x0fff)
+		ticks := low | mid<<32 | high<<48
+		t := time.Unix(0, int64(ticks-uuidEpochOffset)*100).UTC()
+		s += " " + t.Format(time.RFC3339Nano)
+	}
+
+	if u.Version() == 7 {
+		s += " " + ids.V7Time(uid).UTC().Format(time.RFC3339Nano)
+	}
+
+	return s + ")"
+}
+
+//
+// Render metadata with keys sorted
+//
+func formatMetadata(metadata parser.Metadata) string {
+
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%q:%q", k, metadata[k])
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+//
+// Render body in canonical form of body format, or raw if it
+// is not parseable
+//
+func formatBody(body []byte, bodyFormat format.BodyFormat) string {
+
+	if len(body) == 0 {
+		return "<empty>"
+	}
+
+	if bodyFormat != nil {
+		var value interface{}
+		if bodyFormat.Parse(body, &value) == nil {
+			if canonical, err := bodyFormat.Serialize(value); err == nil {
+				return string(canonical)
+			}
+		}
+	}
+
+	return fmt.Sprintf("%q", body)
+}
@@ -0,0 +1,126 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"bytes"
+	"github.com/satori/go.uuid"
+	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/parser"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+// Buffer safe to write from connection loops
+//
+type syncBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+//
+// Test frame hooks see system and user frames and debug
+// output renders them
+//
+func TestFrameTaps(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	in := make(chan parser.Frame, 16)
+	debug := &syncBuffer{}
+
+	ready := make(chan bool)
+
+	go (func() {
+
+		defer close(ready)
+
+		_, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			OnFrameIn: func(frame parser.Frame) { in <- frame },
+			Debug:     debug,
+		})
+
+		if err != nil {
+			t.Error(err)
+		}
+
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(chan parser.Frame, 16)
+	server.OnFrameOut(func(frame parser.Frame) { out <- frame })
+
+	server.SendEvent("foo", map[string]int{"a": 1}, WithHeader("k", "v"))
+
+	for _, expected := range []parser.FrameType{parser.SYSTEM_HANDSHAKE, parser.EVENT} {
+		select {
+		case frame := <-in:
+			if frame.GetType() != expected {
+				t.Fatal("Expected", expected, "got", frame.GetType())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected", expected, "frame in")
+		}
+	}
+
+	if frame := <-out; frame.GetType() != parser.EVENT {
+		t.Fatal("Expected event out, got", frame.GetType())
+	}
+
+	lines := strings.Split(debug.String(), "\n")
+
+	if !strings.HasPrefix(lines[0], "> system.handshake version=3") {
+		t.Fatal("Expected handshake out first, got", lines[0])
+	}
+
+	if !strings.HasPrefix(lines[1], "< system.handshake") {
+		t.Fatal("Expected handshake in, got", lines[1])
+	}
+
+	if !strings.HasPrefix(lines[2], "< event uid=") || !strings.HasSuffix(lines[2], ` uri="foo" header={"k":"v"} body={"a":1}`) {
+		t.Fatal("Unexpected event line", lines[2])
+	}
+}
+
+func TestFormatUid(t *testing.T) {
+
+	uid := uuid.NewV1()
+	before := time.Now().UTC().Add(-time.Second)
+
+	s := FormatUid(uid)
+	parts := strings.Fields(strings.Trim(s[len(uid.String()):], "()"))
+
+	if len(parts) != 2 || parts[0] != "v1" {
+		t.Fatal("Unexpected uid rendering", s)
+	}
+
+	generated, err := time.Parse(time.RFC3339Nano, parts[1])
+	if err != nil || generated.Before(before) || generated.After(before.Add(2*time.Second)) {
+		t.Fatal("Expected generation time to be decoded, got", s, err)
+	}
+}
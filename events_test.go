@@ -5,11 +5,16 @@
 package yamp
 
 import (
+	"context"
 	"github.com/yyyar/yamp-go/api"
 	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/logging"
+	"github.com/yyyar/yamp-go/parser"
 	"io"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 //
@@ -27,7 +32,8 @@ func TestEvents(t *testing.T) {
 		client, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
 
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
 		client.OnEvent("foo", func(event *api.Event) {
@@ -53,3 +59,444 @@ func TestEvents(t *testing.T) {
 
 	wg.Wait()
 }
+
+//
+// Test events larger than fragment size are delivered whole, small
+// events of other lanes are not blocked by them, and events of the
+// same lane keep their order
+//
+func TestFragmentedEvents(t *testing.T) {
+
+	const SIZE = 1024 * 1024
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	received := make(chan int, 3)
+	order := make(chan string, 3)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			OnFrameIn: func(frame parser.Frame) {
+				if event, ok := frame.(*parser.Event); ok {
+					order <- event.Uri
+				}
+			},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnEvent("big", func(event *api.Event) {
+			received <- len(event.RawBody())
+		})
+
+		client.OnEvent("small", func(event *api.Event) {
+			received <- len(event.RawBody())
+		})
+
+		client.OnEvent("urgent", func(event *api.Event) {
+			received <- len(event.RawBody())
+		})
+
+	})()
+
+	server, err := NewConnectionWithOptions(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{}, Options{
+		FragmentSize: 1024,
+	})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.SendEvent("big", make([]byte, SIZE))
+	go server.SendEvent("small", 1)
+	server.SendEvent("urgent", 2, WithPriority(PRIORITY_HIGH))
+
+	// Event of other lane overtakes big one split into a thousand
+	// fragments, event of the same lane waits for it
+
+	for _, uri := range []string{"urgent", "big", "small"} {
+		if got := <-order; got != uri {
+			t.Fatal("Expected event", uri, "got", got)
+		}
+	}
+
+	// Big one comes whole, base64 encoded by json
+	sizes := map[int]bool{<-received: true, <-received: true, <-received: true}
+	if !sizes[(SIZE+2)/3*4+2] {
+		t.Fatal("Bad size of reassembled event", sizes)
+	}
+}
+
+//
+// countingWriter counts writes made to underlying writer
+//
+type countingWriter struct {
+	io.Writer
+	writes int32
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt32(&w.writes, 1)
+	return w.Writer.Write(p)
+}
+
+//
+// Test events sent in a row are coalesced into few writes
+//
+func TestWriteBatching(t *testing.T) {
+
+	const N = 100
+
+	var wg sync.WaitGroup
+	wg.Add(N)
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnEvent("foo", func(event *api.Event) {
+			wg.Done()
+		})
+
+	})()
+
+	writer := &countingWriter{Writer: w1}
+
+	server, err := NewConnectionWithOptions(false, &MockConnection{r2, writer}, &format.JsonBodyFormat{}, Options{
+		WriteMaxLatency: 50 * time.Millisecond,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-ready
+
+	before := atomic.LoadInt32(&writer.writes)
+
+	for i := 0; i < N; i++ {
+		server.SendEvent("foo", i)
+	}
+
+	wg.Wait()
+
+	writes := atomic.LoadInt32(&writer.writes) - before
+	t.Log("Events", N, "written with", writes, "writes")
+
+	if writes >= N/10 {
+		t.Fatal("Expected events to be coalesced, got", writes, "writes")
+	}
+}
+
+//
+// testLogger records logged messages with their fields
+//
+type testLogger chan map[string]interface{}
+
+func (l testLogger) Log(level logging.Level, message string, fields ...logging.Field) {
+
+	record := map[string]interface{}{"message": message}
+	for _, field := range fields {
+		record[field.Key] = field.Value
+	}
+
+	l <- record
+}
+
+//
+// Test dropped events are logged to connection logger
+// with connection id and uri
+//
+func TestEventsLogger(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	logger := make(testLogger, 1)
+	ready := make(chan *Connection)
+
+	go (func() {
+
+		client, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			Logger: logger,
+		})
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		ready <- client
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := <-ready
+
+	server.SendEvent("nobody", nil)
+
+	select {
+	case record := <-logger:
+		if record["message"] != "No handlers for event" || record[logging.FIELD_URI] != "nobody" || record[logging.FIELD_CONNECTION] != client.Id() {
+			t.Fatal("Unexpected log record", record)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected dropped event to be logged")
+	}
+}
+
+//
+// Test channel subscriptions deliver events in order
+// and apply overflow policy
+//
+func TestSubscribe(t *testing.T) {
+
+	const N = 10
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan *Connection)
+
+	go (func() {
+		client, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+		}
+		ready <- client
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	client := <-ready
+
+	if err != nil || client == nil {
+		t.Fatal("Expected connections", err)
+	}
+
+	// Subscriptions are fed in order, so once last one got
+	// event, others got it too
+	if _, _, err := client.SubscribeWithOverflow("foo", 0, api.OVERFLOW_DROP_OLDEST); err != ErrBufferSize {
+		t.Fatal("Expected unbuffered drop oldest subscription to be rejected, got", err)
+	}
+
+	_, newest, _ := client.SubscribeWithOverflow("foo", 2, api.OVERFLOW_DROP_NEWEST)
+	oldestEvents, oldest, _ := client.SubscribeWithOverflow("foo", 2, api.OVERFLOW_DROP_OLDEST)
+	events, all := client.Subscribe("foo", N)
+
+	for i := 0; i < N; i++ {
+		server.SendEvent("foo", i)
+	}
+
+	for i := 0; i < N; i++ {
+		var n int
+		(<-events).Read(&n)
+		if n != i {
+			t.Fatal("Expected event", i, "got", n)
+		}
+	}
+
+	if all.Dropped() != 0 || newest.Dropped() != N-2 || oldest.Dropped() != N-2 {
+		t.Fatal("Unexpected dropped counts", all.Dropped(), newest.Dropped(), oldest.Dropped())
+	}
+
+	for _, expected := range []int{N - 2, N - 1} {
+		var n int
+		(<-oldestEvents).Read(&n)
+		if n != expected {
+			t.Fatal("Expected newest events to be kept, got", n)
+		}
+	}
+
+	all.Unsubscribe()
+
+	if _, ok := <-events; ok {
+		t.Fatal("Expected events channel to be closed")
+	}
+
+	// Remaining subscriptions are closed once connection drops
+	w1.Close()
+
+	closed := make(chan bool)
+	go (func() {
+		for range oldestEvents {
+		}
+		close(closed)
+	})()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected subscription to be closed with connection")
+	}
+
+	late, _ := client.Subscribe("foo", 1)
+	if _, ok := <-late; ok {
+		t.Fatal("Expected subscription of closed connection to be closed")
+	}
+}
+
+//
+// Test acked events are confirmed once handled and
+// redelivered over new connection sharing outbox
+//
+func TestAckedEvents(t *testing.T) {
+
+	outbox := NewOutbox()
+	handled := make(chan int, 8)
+	stuck := make(chan bool)
+
+	defer close(stuck)
+
+	// Connect pair where receiver handles events with handler
+	connect := func(handler api.EventHandler) (*Connection, *Connection) {
+
+		r1, w1 := io.Pipe()
+		r2, w2 := io.Pipe()
+
+		ready := make(chan *Connection)
+
+		go (func() {
+			client, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+			if err != nil {
+				t.Error(err)
+			}
+			client.OnEvent("foo", handler)
+			ready <- client
+		})()
+
+		server, err := NewConnectionWithOptions(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{}, Options{
+			Outbox: outbox,
+		})
+		client := <-ready
+
+		if err != nil || client == nil {
+			t.Fatal("Expected connections", err)
+		}
+
+		return server, client
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Confirmed once handler returned
+
+	server, _ := connect(func(event *api.Event) {
+		var n int
+		event.Read(&n)
+		if n == 2 {
+			<-stuck
+		}
+		handled <- n
+	})
+
+	if err := server.SendEventAcked("foo", 1).Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := <-handled; n != 1 {
+		t.Fatal("Expected event to be handled before confirmation, got", n)
+	}
+
+	// Unconfirmed event is redelivered over new connection
+
+	delivery := server.SendEventAcked("foo", 2)
+
+	server.Close("bye")
+
+	connect(func(event *api.Event) {
+		var n int
+		event.Read(&n)
+		handled <- n
+	})
+
+	if err := delivery.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := <-handled; n != 2 {
+		t.Fatal("Expected event to be redelivered, got", n)
+	}
+
+	if outbox.Pending() != 0 {
+		t.Fatal("Expected empty outbox, got", outbox.Pending())
+	}
+}
+
+//
+// Test acked events are retransmitted until confirmed
+//
+func TestAckedEventsRetransmit(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	outbox := NewOutbox()
+	outbox.Timeout = 20 * time.Millisecond
+
+	var calls int32
+	ready := make(chan bool)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnEvent("slow", func(event *api.Event) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(100 * time.Millisecond)
+		})
+
+	})()
+
+	server, err := NewConnectionWithOptions(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{}, Options{
+		Outbox: outbox,
+	})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := server.SendEventAcked("slow", nil).Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&calls); n < 2 {
+		t.Fatal("Expected event to be retransmitted, handled", n, "times")
+	}
+
+	if err := server.SendEventAcked("slow", nil, WithTimeout(10*time.Millisecond)).Wait(ctx); err != api.ErrDeadlineExceeded {
+		t.Fatal("Expected deadline exceeded, got", err)
+	}
+}
@@ -0,0 +1,65 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/logging"
+	"github.com/yyyar/yamp-go/parser"
+)
+
+//
+// OnFrame sets handler of extension frames of given type, registered
+// with parser.RegisterFrameType. Handler is called from connection
+// read loop in order frames came, so it should not block
+//
+func (c *Connection) OnFrame(frameType parser.FrameType, handler api.FrameHandler) error {
+
+	if frameType < parser.FRAME_TYPE_EXTENSION {
+		return parser.ErrReservedFrameType
+	}
+
+	c.frameHandlersLock.Lock()
+	defer c.frameHandlersLock.Unlock()
+
+	c.frameHandlers[frameType] = handler
+
+	return nil
+}
+
+//
+// SendFrame sends extension frame to other party
+//
+func (c *Connection) SendFrame(frame parser.Frame) error {
+
+	if frame.GetType() < parser.FRAME_TYPE_EXTENSION {
+		return parser.ErrReservedFrameType
+	}
+
+	if c.State() != STATE_OPEN {
+		return ErrClosed
+	}
+
+	c.framesOut <- frame
+
+	return nil
+}
+
+//
+// Pass extension frame to its handler
+//
+func (c *Connection) dispatchExtension(frame parser.Frame) {
+
+	c.frameHandlersLock.RLock()
+	handler, ok := c.frameHandlers[frame.GetType()]
+	c.frameHandlersLock.RUnlock()
+
+	if !ok {
+		c.logger.Log(logging.LEVEL_WARN, "Unhandled frame", logging.F(logging.FIELD_FRAME_TYPE, frame.GetType()))
+		return
+	}
+
+	handler(frame)
+}
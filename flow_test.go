@@ -0,0 +1,372 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/parser"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+// Test responder can't send progress responses ahead of credit
+//
+func TestFlowControl(t *testing.T) {
+
+	const (
+		WINDOW = 4
+		N      = 20
+	)
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	sent := make(chan int)
+
+	// Run responder
+	go (func() {
+
+		defer close(ready)
+
+		client, _ := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+
+		client.OnRequest("flood", func(req *api.Request, res *api.Response) {
+
+			// Wait for initial credit, then send until out of it
+			res.Progress(0)
+
+			count := 1
+			for res.TryProgress(count) == nil {
+				count++
+			}
+			sent <- count
+
+			// Then continue respecting credit
+			for ; count < N; count++ {
+				if err := res.Progress(count); err != nil {
+					t.Error(err)
+				}
+			}
+
+			res.Done(N)
+		})
+
+	})()
+
+	// Run requester
+	server, _ := NewConnectionWithOptions(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{}, Options{
+		ProgressWindow: WINDOW,
+	})
+	<-ready
+
+	if !server.HasFeature(parser.FEATURE_FLOW_CONTROL) || server.Version() != YAMP_VERSION {
+		t.Fatal("Flow control is not negotiated")
+	}
+
+	stream := server.Call("flood", nil)
+
+	if count := <-sent; count != WINDOW {
+		t.Fatal("Expected", WINDOW, "progress responses ahead of consumer, got", count)
+	}
+
+	for i := 0; i <= N; i++ {
+
+		res, ok := stream.Next()
+		if !ok {
+			t.Fatal("Stream ended too early at", i)
+		}
+
+		var body int
+		res.Read(&body)
+
+		if body != i {
+			t.Fatal("Expected", i, "got", body)
+		}
+	}
+}
+
+//
+// Test version 1 client is still able to talk to the server
+//
+func TestVersion1Handshake(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			Version: 1,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("echo", func(req *api.Request, res *api.Response) {
+			var body string
+			req.Read(&body)
+			res.Progress(body)
+			res.Done(body)
+		})
+
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.Version() != 1 || server.HasFeature(parser.FEATURE_FLOW_CONTROL) {
+		t.Fatal("Expected version 1 without features, got", server.Version())
+	}
+
+	stream := server.Call("echo", "hello")
+
+	for _, done := range []bool{false, true} {
+
+		res, ok := stream.Next()
+		if !ok || res.IsDone() != done {
+			t.Fatal("Unexpected response")
+		}
+	}
+}
+
+//
+// Test long uris pass with varint lengths, and are rejected
+// on send instead of truncated when older version is negotiated
+//
+func TestLongUri(t *testing.T) {
+
+	uri := strings.Repeat("u", 1000)
+
+	for _, version := range []uint16{YAMP_VERSION, 2} {
+
+		r1, w1 := io.Pipe()
+		r2, w2 := io.Pipe()
+
+		ready := make(chan bool)
+
+		go (func() {
+
+			defer close(ready)
+
+			client, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+				Version: version,
+			})
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			client.OnRequest(uri, func(req *api.Request, res *api.Response) {
+				res.Done("ok")
+			})
+
+		})()
+
+		server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+		<-ready
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, _ := server.Call(uri, nil).Next()
+
+		if version >= parser.VERSION_VARINT_LENGTHS {
+			if !res.IsDone() {
+				t.Fatal("Expected request with long uri to succeed")
+			}
+			continue
+		}
+
+		if !res.IsError() {
+			t.Fatal("Expected error response for long uri on version", version)
+		}
+
+		if err := server.SendEvent(uri, nil); err != parser.ErrFieldTooLong {
+			t.Fatal("Expected field too long error, got", err)
+		}
+	}
+}
+
+//
+// Test long metadata headers are rejected on send when older version is
+// negotiated, and request that fails to serialize anyway gets error response
+//
+func TestLongHeader(t *testing.T) {
+
+	long := strings.Repeat("h", 300)
+
+	dir, err := ioutil.TempDir("", "yamp-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(filepath.Join(dir, "spool"), &format.JsonBodyFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	// Spooled frames are not checked against version of connection
+	if err := spool.SendRequest("foo", nil, WithHeader(long, "value")); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := make(chan *api.Response, 1)
+	spool.ResponseHandler = func(response *api.Response) {
+		responses <- response
+	}
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			Version: 2,
+		})
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("foo", func(req *api.Request, res *api.Response) {
+			res.Done("ok")
+		})
+
+	})()
+
+	server, err := NewConnectionWithOptions(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{}, Options{
+		Spool: spool,
+	})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.SendEvent("foo", nil, WithHeader("key", strings.Repeat("v", 70000))); err != parser.ErrFieldTooLong {
+		t.Fatal("Expected field too long error for long value, got", err)
+	}
+
+	res, _ := server.Call("foo", nil, WithHeader(long, "value")).Next()
+
+	if !res.IsError() {
+		t.Fatal("Expected error response for long key")
+	}
+
+	select {
+	case response := <-responses:
+		if !response.IsError() {
+			t.Fatal("Expected error response to spooled request, got", response.Frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected spooled request that failed to serialize to be answered")
+	}
+
+	if pending := server.PendingRequests(); len(pending) != 0 {
+		t.Fatal("Expected no pending requests, got", pending)
+	}
+
+	res, _ = server.Call("foo", nil, WithHeader("key", "value")).Next()
+
+	if !res.IsDone() {
+		t.Fatal("Expected request with short header to succeed")
+	}
+}
+
+//
+// Test frames larger than fragment size don't get overtaken by frames
+// of the same lane sent after them: initial credit of large request
+// and terminal response after large progress one
+//
+func TestFragmentedOrder(t *testing.T) {
+
+	const SIZE = 200 * 1024
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	// Run responder
+	go (func() {
+
+		defer close(ready)
+
+		client, _ := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+
+		client.OnRequest("large_request", func(req *api.Request, res *api.Response) {
+			res.Progress(1)
+			res.Done(2)
+		})
+
+		client.OnRequest("large_progress", func(req *api.Request, res *api.Response) {
+			res.Progress(strings.Repeat("x", SIZE))
+			res.Done(2)
+		})
+
+	})()
+
+	// Run requester
+	server, _ := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	for uri, body := range map[string]interface{}{
+		"large_request":  strings.Repeat("x", SIZE),
+		"large_progress": nil,
+	} {
+
+		stream := server.Call(uri, body)
+		types := make(chan string, 2)
+
+		go (func() {
+			for {
+				res, ok := stream.Next()
+				if !ok {
+					return
+				}
+				types <- res.Frame.Type.String()
+			}
+		})()
+
+		for _, expected := range []string{"progress", "done"} {
+			select {
+			case got := <-types:
+				if got != expected {
+					t.Fatal(uri, "expected", expected, "response, got", got)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal(uri, "expected", expected, "response, got none")
+			}
+		}
+	}
+}
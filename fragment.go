@@ -0,0 +1,157 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/satori/go.uuid"
+	"github.com/yyyar/yamp-go/parser"
+)
+
+//
+// fragmenter splits serialized frame into fragments
+//
+type fragmenter struct {
+	uid    uuid.UUID
+	writer *parser.Writer
+	data   []byte
+	size   int
+
+	// Lane frame came from, held until last fragment is written
+	priority Priority
+}
+
+//
+// Create fragmenter of frame serialized by writer, with fragments
+// sharing uid. Writer is released once last fragment is cut
+//
+func newFragmenter(writer *parser.Writer, size int, uid uuid.UUID) *fragmenter {
+	return &fragmenter{
+		uid:    uid,
+		writer: writer,
+		data:   writer.Bytes(),
+		size:   size,
+	}
+}
+
+//
+// Cut and serialize next fragment. Returns true if it is the last one
+//
+func (f *fragmenter) next() (*parser.Fragment, *parser.Writer, bool) {
+
+	size := f.size
+	if size > len(f.data) {
+		size = len(f.data)
+	}
+
+	fragment := &parser.Fragment{
+		FrameUid: f.uid,
+		Last:     size == len(f.data),
+		Data:     f.data[:size],
+	}
+
+	f.data = f.data[size:]
+
+	writer := parser.AcquireWriter()
+	writer.SetVersion(f.writer.Version())
+	fragment.Serialize(writer)
+
+	if fragment.Last {
+		parser.ReleaseWriter(f.writer)
+	}
+
+	return fragment, writer, fragment.Last
+}
+
+//
+// reassembler collects fragments back into frames
+//
+type reassembler struct {
+	frames map[uuid.UUID]*bytes.Buffer
+	limits parser.Limits
+
+	// Protocol version and features of reassembled frames
+	version  uint16
+	features uint32
+}
+
+//
+// Create empty reassembler enforcing limits on reassembled frames
+//
+func newReassembler(limits parser.Limits, version uint16, features uint32) *reassembler {
+	return &reassembler{
+		frames:   make(map[uuid.UUID]*bytes.Buffer),
+		limits:   limits,
+		version:  version,
+		features: features,
+	}
+}
+
+//
+// Add fragment and return reassembled frame once last fragment came
+//
+func (r *reassembler) add(fragment *parser.Fragment) (parser.Frame, error) {
+
+	buffer, ok := r.frames[fragment.FrameUid]
+	if !ok {
+
+		if max := r.limits.MaxPartialFrames; max > 0 && uint64(len(r.frames)) >= uint64(max) {
+			return nil, &parser.ProtocolError{
+				Code:    parser.CLOSE_PROTOCOL_ERROR,
+				Message: fmt.Sprintf("More than %d fragmented frames at once", max),
+			}
+		}
+
+		buffer = &bytes.Buffer{}
+		r.frames[fragment.FrameUid] = buffer
+	}
+
+	buffer.Write(fragment.Data)
+
+	if max := r.limits.MaxFrameSize; max > 0 && uint64(buffer.Len()) > uint64(max) {
+		return nil, &parser.ProtocolError{
+			Code:    parser.CLOSE_FRAME_TOO_LARGE,
+			Message: fmt.Sprintf("Fragmented frame exceeds limit of %d bytes", max),
+		}
+	}
+
+	if !fragment.Last {
+		return nil, nil
+	}
+
+	delete(r.frames, fragment.FrameUid)
+
+	size := uint64(buffer.Len())
+	reader := parser.NewReader(buffer, r.limits)
+	reader.SetVersion(r.version)
+	reader.SetFeatures(r.features)
+
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		return nil, r.malformed(err)
+	}
+
+	if frame.GetType() == parser.FRAGMENT || reader.FrameSize() != size {
+		return nil, r.malformed(nil)
+	}
+
+	return frame, nil
+}
+
+//
+// Wrap error of parsing reassembled frame into protocol error
+//
+func (r *reassembler) malformed(err error) error {
+
+	if protocolErr, ok := err.(*parser.ProtocolError); ok {
+		return protocolErr
+	}
+
+	return &parser.ProtocolError{
+		Code:    parser.CLOSE_PROTOCOL_ERROR,
+		Message: "Malformed fragmented frame",
+	}
+}
@@ -0,0 +1,40 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package ids
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+//
+// CounterGenerator creates ids from random 64 bits prefix chosen
+// once per generator, followed by 64 bits counter. It is the cheapest
+// generator, but ids are not UUIDs and reveal number of frames sent
+//
+type CounterGenerator struct {
+	prefix  [8]byte
+	counter uint64
+}
+
+//
+// NewCounterGenerator creates counter generator with random prefix
+//
+func NewCounterGenerator() *CounterGenerator {
+
+	g := &CounterGenerator{}
+	random(g.prefix[:])
+
+	return g
+}
+
+func (g *CounterGenerator) NewId() [16]byte {
+
+	var id [16]byte
+	copy(id[:8], g.prefix[:])
+	binary.BigEndian.PutUint64(id[8:], atomic.AddUint64(&g.counter, 1))
+
+	return id
+}
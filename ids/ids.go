@@ -0,0 +1,95 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package ids
+
+import (
+	"crypto/rand"
+	"github.com/satori/go.uuid"
+)
+
+//
+// Generator creates uids of frames. Implementations
+// should be safe for concurrent use
+//
+type Generator interface {
+
+	//
+	// NewId returns new unique id
+	//
+	NewId() [16]byte
+}
+
+//
+// Default generator used unless other one is configured. Random
+// ids don't expose host address and generation time to other party
+//
+var Default Generator = V4Generator{}
+
+//
+// Namespace of uids derived from idempotency keys
+//
+var keyNamespace = uuid.NewV5(uuid.NamespaceURL, "https://github.com/yyyar/yamp-go/idempotency-key")
+
+//
+// FromKey derives uid from idempotency key. Same key always
+// yields same uid (UUID v5), so retries of request are recognizable
+//
+func FromKey(key string) [16]byte {
+	return uuid.NewV5(keyNamespace, key)
+}
+
+//
+// Generate returns new id of generator, or of Default one if it is nil
+//
+func Generate(generator Generator) [16]byte {
+
+	if generator == nil {
+		generator = Default
+	}
+
+	return generator.NewId()
+}
+
+//
+// V1Generator creates time and MAC address based UUIDs v1.
+// Original yamp behavior, kept for compatibility
+//
+type V1Generator struct{}
+
+func (V1Generator) NewId() [16]byte {
+	return uuid.NewV1()
+}
+
+//
+// V4Generator creates random UUIDs v4
+//
+type V4Generator struct{}
+
+func (V4Generator) NewId() [16]byte {
+
+	var id [16]byte
+	random(id[:])
+
+	setVersion(&id, 4)
+
+	return id
+}
+
+//
+// Fill buffer with cryptographically secure random bytes
+//
+func random(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+//
+// Set version and RFC 4122 variant bits of UUID
+//
+func setVersion(id *[16]byte, version byte) {
+	id[6] = id[6]&0x0f | version<<4
+	id[8] = id[8]&0x3f | 0x80
+}
@@ -0,0 +1,70 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package ids
+
+import (
+	"bytes"
+	"github.com/satori/go.uuid"
+	"testing"
+	"time"
+)
+
+func TestV4(t *testing.T) {
+
+	a, b := V4Generator{}.NewId(), V4Generator{}.NewId()
+
+	if a == b {
+		t.Fatal("Expected different ids")
+	}
+
+	if u := uuid.UUID(a); u.Version() != 4 || u.Variant() != uuid.VariantRFC4122 {
+		t.Fatal("Expected RFC 4122 UUID v4, got", u)
+	}
+}
+
+func TestV7(t *testing.T) {
+
+	g := NewV7Generator()
+	before := time.Now().Add(-time.Millisecond)
+
+	prev := g.NewId()
+
+	for i := 0; i < 10000; i++ {
+		id := g.NewId()
+		if bytes.Compare(prev[:], id[:]) >= 0 {
+			t.Fatal("Expected increasing ids, got", uuid.UUID(prev), uuid.UUID(id))
+		}
+		prev = id
+	}
+
+	if u := uuid.UUID(prev); u.Version() != 7 || u.Variant() != uuid.VariantRFC4122 {
+		t.Fatal("Expected RFC 4122 UUID v7, got", u)
+	}
+
+	if generated := V7Time(prev); generated.Before(before) || generated.After(time.Now().Add(time.Second)) {
+		t.Fatal("Unexpected generation time", generated)
+	}
+}
+
+func TestCounter(t *testing.T) {
+
+	g := NewCounterGenerator()
+	a, b := g.NewId(), g.NewId()
+
+	if !bytes.Equal(a[:8], b[:8]) || a[15]+1 != b[15] {
+		t.Fatal("Expected same prefix and consecutive counters, got", a, b)
+	}
+}
+
+func TestFromKey(t *testing.T) {
+
+	if FromKey("order-1") != FromKey("order-1") {
+		t.Fatal("Expected same uid for same key")
+	}
+
+	if FromKey("order-1") == FromKey("order-2") {
+		t.Fatal("Expected different uids for different keys")
+	}
+}
@@ -0,0 +1,90 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package ids
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+//
+// Max value of 12 bits sequence of UUID v7
+//
+const v7MaxSequence = 0x0fff
+
+//
+// V7Generator creates UUIDs v7: 48 bits of unix time in milliseconds
+// followed by random bits. Like ULIDs, they sort by generation time.
+// Ids of single generator are strictly increasing, with 12 bits counter
+// ordering ones created within same millisecond
+//
+type V7Generator struct {
+	lock     sync.Mutex
+	last     int64
+	sequence uint16
+}
+
+//
+// NewV7Generator creates UUIDs v7 generator
+//
+func NewV7Generator() *V7Generator {
+	return &V7Generator{}
+}
+
+func (g *V7Generator) NewId() [16]byte {
+
+	var id [16]byte
+	random(id[8:])
+
+	ms, sequence := g.next()
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(ms))
+	copy(id[0:6], ts[2:])
+
+	binary.BigEndian.PutUint16(id[6:8], sequence)
+
+	setVersion(&id, 7)
+
+	return id
+}
+
+//
+// Timestamp and sequence of next id. If sequence of millisecond
+// is exhausted, timestamp runs ahead of clock to keep ids increasing
+//
+func (g *V7Generator) next() (int64, uint16) {
+
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if ms > g.last {
+		g.last = ms
+		g.sequence = 0
+	} else if g.sequence < v7MaxSequence {
+		g.sequence++
+	} else {
+		g.last++
+		g.sequence = 0
+	}
+
+	return g.last, g.sequence
+}
+
+//
+// V7Time returns generation time of UUID v7
+//
+func V7Time(id [16]byte) time.Time {
+
+	var ts [8]byte
+	copy(ts[2:], id[0:6])
+
+	ms := int64(binary.BigEndian.Uint64(ts[:]))
+
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,118 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package logging
+
+import (
+	"fmt"
+)
+
+//
+// Level is severity of log message
+//
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+)
+
+//
+// String returns name of level
+//
+func (l Level) String() string {
+
+	switch l {
+	case LEVEL_DEBUG:
+		return "DEBUG"
+	case LEVEL_INFO:
+		return "INFO"
+	case LEVEL_WARN:
+		return "WARN"
+	case LEVEL_ERROR:
+		return "ERROR"
+	}
+
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+//
+// Keys of fields attached by yamp
+//
+const (
+	FIELD_CONNECTION = "connection"
+	FIELD_URI        = "uri"
+	FIELD_UID        = "uid"
+	FIELD_FRAME_TYPE = "frame_type"
+	FIELD_ERROR      = "error"
+)
+
+//
+// Field is key/value pair attached to log message
+//
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+//
+// F creates field
+//
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+//
+// Logger receives structured log messages
+//
+type Logger interface {
+	Log(level Level, message string, fields ...Field)
+}
+
+//
+// Default logger used when none is configured,
+// writes messages of level INFO and above to standard log
+//
+var Default Logger = NewStdLogger(LEVEL_INFO)
+
+//
+// Discard logger drops all messages
+//
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Log(Level, string, ...Field) {}
+
+//
+// With returns logger attaching fields to every message
+//
+func With(logger Logger, fields ...Field) Logger {
+
+	if w, ok := logger.(*withLogger); ok {
+		return &withLogger{
+			logger: w.logger,
+			fields: append(append([]Field{}, w.fields...), fields...),
+		}
+	}
+
+	return &withLogger{
+		logger: logger,
+		fields: fields,
+	}
+}
+
+//
+// Logger attaching fields to every message
+//
+type withLogger struct {
+	logger Logger
+	fields []Field
+}
+
+func (w *withLogger) Log(level Level, message string, fields ...Field) {
+	w.logger.Log(level, message, append(append([]Field{}, w.fields...), fields...)...)
+}
@@ -0,0 +1,35 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package logging
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+//
+// Test std logger filters levels and formats fields
+//
+func TestStdLogger(t *testing.T) {
+
+	var buffer bytes.Buffer
+
+	logger := With(&StdLogger{
+		Level:  LEVEL_INFO,
+		Logger: log.New(&buffer, "", 0),
+	}, F(FIELD_CONNECTION, 1))
+
+	logger = With(logger, F(FIELD_URI, "foo"))
+
+	logger.Log(LEVEL_DEBUG, "Hidden")
+	logger.Log(LEVEL_WARN, "No handlers for event", F(FIELD_ERROR, "some error"))
+
+	expected := "WARN No handlers for event connection=1 uri=foo error=\"some error\"\n"
+
+	if buffer.String() != expected {
+		t.Fatalf("Expected %q got %q", expected, buffer.String())
+	}
+}
@@ -0,0 +1,59 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+//go:build go1.21
+// +build go1.21
+
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+//
+// SlogLogger writes messages to slog.Logger
+//
+type SlogLogger struct {
+	Logger *slog.Logger
+}
+
+//
+// NewSlogLogger creates logger writing to logger
+//
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	return &SlogLogger{
+		Logger: logger,
+	}
+}
+
+//
+// Log writes message with fields as slog attributes
+//
+func (l *SlogLogger) Log(level Level, message string, fields ...Field) {
+
+	attrs := make([]slog.Attr, len(fields))
+	for i, field := range fields {
+		attrs[i] = slog.Any(field.Key, field.Value)
+	}
+
+	l.Logger.LogAttrs(context.Background(), slogLevel(level), message, attrs...)
+}
+
+//
+// Map level to slog one
+//
+func slogLevel(level Level) slog.Level {
+
+	switch level {
+	case LEVEL_DEBUG:
+		return slog.LevelDebug
+	case LEVEL_INFO:
+		return slog.LevelInfo
+	case LEVEL_WARN:
+		return slog.LevelWarn
+	}
+
+	return slog.LevelError
+}
@@ -0,0 +1,73 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+//
+// StdLogger writes messages to standard log.Logger
+// as text lines with key=value fields
+//
+type StdLogger struct {
+
+	// Min level of written messages
+	Level Level
+
+	// Logger to write to, nil means standard one
+	Logger *log.Logger
+}
+
+//
+// NewStdLogger creates logger writing messages of level
+// and above to standard logger
+//
+func NewStdLogger(level Level) *StdLogger {
+	return &StdLogger{
+		Level: level,
+	}
+}
+
+//
+// Log writes message if its level is enabled
+//
+func (l *StdLogger) Log(level Level, message string, fields ...Field) {
+
+	if level < l.Level {
+		return
+	}
+
+	var line bytes.Buffer
+
+	line.WriteString(level.String())
+	line.WriteByte(' ')
+	line.WriteString(message)
+
+	for _, field := range fields {
+
+		line.WriteByte(' ')
+		line.WriteString(field.Key)
+		line.WriteByte('=')
+
+		value := fmt.Sprint(field.Value)
+
+		// Quote values that would break key=value format
+		if value == "" || bytes.ContainsAny([]byte(value), " =\"\n") {
+			value = strconv.Quote(value)
+		}
+
+		line.WriteString(value)
+	}
+
+	if l.Logger != nil {
+		l.Logger.Output(2, line.String())
+	} else {
+		log.Output(2, line.String())
+	}
+}
@@ -0,0 +1,76 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/metrics"
+	"github.com/yyyar/yamp-go/parser"
+	"io"
+	"time"
+)
+
+//
+// Metrics returns metrics of connection. They are
+// aggregated in metrics.Process as well
+//
+func (c *Connection) Metrics() *metrics.Metrics {
+	return c.metrics
+}
+
+//
+// Account incoming request finished with terminal response
+//
+func (c *Connection) requestHandled(request *parser.Request, response *api.Response, latency time.Duration) {
+	c.metrics.RequestHandled(request.Uri, response.Frame.Type.String(), latency)
+}
+
+//
+// Write frame directly to transport, bypassing write loop.
+// Used only before write loop is started
+//
+func (c *Connection) writeDirect(frame parser.Frame) error {
+
+	writer := parser.AcquireWriter()
+	defer parser.ReleaseWriter(writer)
+
+	c.frameOut(frame)
+
+	if err := frame.Serialize(writer); err != nil {
+		return err
+	}
+
+	c.metrics.FrameOut(frame.GetType().String(), writer.Len())
+
+	_, err := c.conn.Write(writer.Bytes())
+	return err
+}
+
+//
+// Read frame directly from transport, before parsing loop is started
+//
+func (c *Connection) readDirect() (parser.Frame, error) {
+
+	frame, err := c.reader.ReadFrame()
+	if err == nil {
+		c.frameIn(frame)
+	}
+
+	return frame, err
+}
+
+//
+// metricsReader accounts bytes read from transport
+//
+type metricsReader struct {
+	reader  io.Reader
+	metrics *metrics.Metrics
+}
+
+func (r *metricsReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.metrics.Read(n)
+	return n, err
+}
@@ -0,0 +1,163 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//
+// Prefix of exported metrics names
+//
+const PREFIX = "yamp_"
+
+//
+// Publish exports process metrics as expvar variable name, served at
+// /debug/vars. Panics if name is already published, as expvar does
+//
+func Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return Process.Snapshot()
+	}))
+}
+
+//
+// Snapshot returns metrics as nested maps, suitable for JSON
+//
+func (m *Metrics) Snapshot() map[string]interface{} {
+
+	counters := func(v *CounterVec) map[string]uint64 {
+		result := map[string]uint64{}
+		v.Each(func(values []string, c *Counter) {
+			result[strings.Join(values, " ")] = c.Value()
+		})
+		return result
+	}
+
+	latency := map[string]HistogramSnapshot{}
+	m.HandlerLatency.Each(func(values []string, h *Histogram) {
+		latency[strings.Join(values, " ")] = h.Snapshot()
+	})
+
+	return map[string]interface{}{
+		"frames_in":       counters(m.FramesIn),
+		"frames_out":      counters(m.FramesOut),
+		"bytes_in":        m.BytesIn.Value(),
+		"bytes_out":       m.BytesOut.Value(),
+		"requests_in":     counters(m.RequestsIn),
+		"requests_out":    counters(m.RequestsOut),
+		"handler_latency": latency,
+		"pending":         m.Pending.Value(),
+		"ping_rtt":        m.PingRtt.Snapshot(),
+		"closes":          counters(m.Closes),
+	}
+}
+
+//
+// WritePrometheus writes metrics in Prometheus text exposition format
+//
+func (m *Metrics) WritePrometheus(writer io.Writer) error {
+
+	w := bufio.NewWriter(writer)
+
+	writeCounterVec(w, "frames_in_total", "Received frames by type", m.FramesIn)
+	writeCounterVec(w, "frames_out_total", "Sent frames by type", m.FramesOut)
+
+	writeHeader(w, "bytes_in_total", "Bytes read from transport", "counter")
+	fmt.Fprintf(w, "%sbytes_in_total %d\n", PREFIX, m.BytesIn.Value())
+
+	writeHeader(w, "bytes_out_total", "Bytes written to transport", "counter")
+	fmt.Fprintf(w, "%sbytes_out_total %d\n", PREFIX, m.BytesOut.Value())
+
+	writeCounterVec(w, "requests_in_total", "Handled requests by uri and response type", m.RequestsIn)
+	writeCounterVec(w, "requests_out_total", "Finished outgoing requests by uri and response type", m.RequestsOut)
+
+	writeHeader(w, "handler_latency_seconds", "Time from request dispatch to terminal response", "histogram")
+	m.HandlerLatency.Each(func(values []string, h *Histogram) {
+		writeHistogram(w, "handler_latency_seconds", labels(m.HandlerLatency.Labels, values), h.Snapshot())
+	})
+
+	writeHeader(w, "pending_requests", "Outgoing requests waiting for response", "gauge")
+	fmt.Fprintf(w, "%spending_requests %d\n", PREFIX, m.Pending.Value())
+
+	writeHeader(w, "ping_rtt_seconds", "Round trip time of pings", "histogram")
+	writeHistogram(w, "ping_rtt_seconds", "", m.PingRtt.Snapshot())
+
+	writeCounterVec(w, "closes_total", "Close frames by code and side", m.Closes)
+
+	return w.Flush()
+}
+
+//
+// Handler serves process metrics in Prometheus text exposition format
+//
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Process.WritePrometheus(w)
+	})
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", PREFIX, name, help, PREFIX, name, kind)
+}
+
+func writeCounterVec(w io.Writer, name, help string, v *CounterVec) {
+
+	writeHeader(w, name, help, "counter")
+
+	v.Each(func(values []string, c *Counter) {
+		fmt.Fprintf(w, "%s%s{%s} %d\n", PREFIX, name, labels(v.Labels, values), c.Value())
+	})
+}
+
+func writeHistogram(w io.Writer, name, labels string, h HistogramSnapshot) {
+
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+
+	for i, bound := range h.Bounds {
+		fmt.Fprintf(w, "%s%s_bucket{%sle=\"%s\"} %d\n", PREFIX, name, prefix, formatFloat(bound), h.Counts[i])
+	}
+
+	fmt.Fprintf(w, "%s%s_bucket{%sle=\"+Inf\"} %d\n", PREFIX, name, prefix, h.Count)
+
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+
+	fmt.Fprintf(w, "%s%s_sum%s %s\n", PREFIX, name, labels, formatFloat(h.Sum))
+	fmt.Fprintf(w, "%s%s_count%s %d\n", PREFIX, name, labels, h.Count)
+}
+
+//
+// Escapes label value as text exposition format requires
+//
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+//
+// Format label pairs, escaping values
+//
+func labels(names, values []string) string {
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=\"" + labelEscaper.Replace(values[i]) + "\""
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
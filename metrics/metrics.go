@@ -0,0 +1,150 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package metrics
+
+import (
+	"time"
+)
+
+//
+// Metrics of connection, or aggregated ones of all connections
+//
+type Metrics struct {
+
+	// Frames by frame type
+	FramesIn  *CounterVec
+	FramesOut *CounterVec
+
+	// Bytes read from and written to transport
+	BytesIn  *Counter
+	BytesOut *Counter
+
+	// Handled incoming requests by uri and response type
+	RequestsIn *CounterVec
+
+	// Finished outgoing requests by uri and response type
+	RequestsOut *CounterVec
+
+	// Time from dispatch of incoming request to its terminal response, by uri
+	HandlerLatency *HistogramVec
+
+	// Outgoing requests waiting for terminal response
+	Pending *Gauge
+
+	// Round trip time of pings
+	PingRtt *Histogram
+
+	// Close frames by code and side ("in" received, "out" sent)
+	Closes *CounterVec
+
+	// Aggregated metrics also updated on every update
+	parent *Metrics
+}
+
+//
+// Process aggregates metrics of all connections of process
+//
+var Process = New(nil)
+
+//
+// New creates empty metrics. Updates are also applied to parent if not nil
+//
+func New(parent *Metrics) *Metrics {
+	return &Metrics{
+		FramesIn:       NewCounterVec("frame_type"),
+		FramesOut:      NewCounterVec("frame_type"),
+		BytesIn:        &Counter{},
+		BytesOut:       &Counter{},
+		RequestsIn:     NewCounterVec("uri", "response_type"),
+		RequestsOut:    NewCounterVec("uri", "response_type"),
+		HandlerLatency: NewHistogramVec(DEFAULT_BUCKETS, "uri"),
+		Pending:        &Gauge{},
+		PingRtt:        NewHistogram(DEFAULT_BUCKETS),
+		Closes:         NewCounterVec("code", "side"),
+		parent:         parent,
+	}
+}
+
+//
+// FrameIn accounts received frame
+//
+func (m *Metrics) FrameIn(frameType string) {
+	for ; m != nil; m = m.parent {
+		m.FramesIn.With(frameType).Add(1)
+	}
+}
+
+//
+// FrameOut accounts sent frame of size bytes
+//
+func (m *Metrics) FrameOut(frameType string, size int) {
+	for ; m != nil; m = m.parent {
+		m.FramesOut.With(frameType).Add(1)
+		m.BytesOut.Add(uint64(size))
+	}
+}
+
+//
+// Read accounts bytes read from transport
+//
+func (m *Metrics) Read(size int) {
+	for ; m != nil; m = m.parent {
+		m.BytesIn.Add(uint64(size))
+	}
+}
+
+//
+// RequestHandled accounts incoming request finished with
+// response of responseType latency after it was dispatched
+//
+func (m *Metrics) RequestHandled(uri, responseType string, latency time.Duration) {
+	for ; m != nil; m = m.parent {
+		m.RequestsIn.With(uri, responseType).Add(1)
+		m.HandlerLatency.With(uri).Observe(latency.Seconds())
+	}
+}
+
+//
+// RequestSent accounts outgoing request waiting for response
+//
+func (m *Metrics) RequestSent() {
+	for ; m != nil; m = m.parent {
+		m.Pending.Add(1)
+	}
+}
+
+//
+// RequestFinished accounts outgoing request finished with response of responseType
+//
+func (m *Metrics) RequestFinished(uri, responseType string) {
+	for ; m != nil; m = m.parent {
+		m.Pending.Add(-1)
+		m.RequestsOut.With(uri, responseType).Add(1)
+	}
+}
+
+//
+// Ping accounts round trip time of ping
+//
+func (m *Metrics) Ping(rtt time.Duration) {
+	for ; m != nil; m = m.parent {
+		m.PingRtt.Observe(rtt.Seconds())
+	}
+}
+
+//
+// Close accounts close frame, received or sent
+//
+func (m *Metrics) Close(code string, received bool) {
+
+	side := "out"
+	if received {
+		side = "in"
+	}
+
+	for ; m != nil; m = m.parent {
+		m.Closes.With(code, side).Add(1)
+	}
+}
@@ -0,0 +1,113 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParentAggregation(t *testing.T) {
+
+	process := New(nil)
+	a, b := New(process), New(process)
+
+	a.FrameIn("event")
+	b.FrameIn("event")
+	b.FrameOut("request", 10)
+	a.RequestSent()
+
+	if v := a.FramesIn.With("event").Value(); v != 1 {
+		t.Fatal("Expected 1 frame in connection, got", v)
+	}
+
+	if v := process.FramesIn.With("event").Value(); v != 2 {
+		t.Fatal("Expected 2 frames in process, got", v)
+	}
+
+	if v := process.BytesOut.Value(); v != 10 {
+		t.Fatal("Expected 10 bytes out in process, got", v)
+	}
+
+	a.RequestFinished("echo", "done")
+
+	if v := process.Pending.Value(); v != 0 {
+		t.Fatal("Expected no pending requests, got", v)
+	}
+
+	if v := process.RequestsOut.With("echo", "done").Value(); v != 1 {
+		t.Fatal("Expected 1 finished request, got", v)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+
+	h := NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	s := h.Snapshot()
+
+	if s.Count != 3 {
+		t.Fatal("Expected 3 observations, got", s.Count)
+	}
+
+	if s.Counts[0] != 1 || s.Counts[1] != 2 {
+		t.Fatal("Expected cumulative counts 1, 2, got", s.Counts)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+
+	m := New(nil)
+	m.FrameIn("event")
+	m.RequestHandled("a\"b", "done", 10*time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := m.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+
+	for _, expected := range []string{
+		"# TYPE yamp_frames_in_total counter",
+		`yamp_frames_in_total{frame_type="event"} 1`,
+		`yamp_requests_in_total{uri="a\"b",response_type="done"} 1`,
+		`yamp_handler_latency_seconds_bucket{uri="a\"b",le="+Inf"} 1`,
+		`yamp_handler_latency_seconds_count{uri="a\"b"} 1`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("Expected %q in output:\n%s", expected, out)
+		}
+	}
+}
+
+//
+// Metrics are published once per process, so repeated runs don't panic
+//
+var publishOnce sync.Once
+
+func TestPublish(t *testing.T) {
+
+	publishOnce.Do(func() {
+
+		if expvar.Get("yamp") != nil {
+			t.Fatal("Expected metrics not to be published on import")
+		}
+
+		Publish("yamp")
+	})
+
+	v := expvar.Get("yamp")
+	if v == nil || !strings.Contains(v.String(), "frames_in") {
+		t.Fatal("Expected published metrics, got", v)
+	}
+}
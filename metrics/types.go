@@ -0,0 +1,280 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//
+// Default histogram buckets, in seconds
+//
+var DEFAULT_BUCKETS = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+//
+// Counter is monotonically increasing value
+//
+type Counter struct {
+	value uint64
+}
+
+//
+// Add increases counter by n
+//
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+//
+// Value returns current value of counter
+//
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+//
+// Gauge is value that may go up and down
+//
+type Gauge struct {
+	value int64
+}
+
+//
+// Add changes gauge by n
+//
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+//
+// Value returns current value of gauge
+//
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+//
+// Histogram counts observed values in buckets
+//
+type Histogram struct {
+	sync.Mutex
+
+	// Upper bounds of buckets, sorted
+	bounds []float64
+
+	// Observations per bucket, last one is +Inf
+	counts []uint64
+
+	sum   float64
+	count uint64
+}
+
+//
+// NewHistogram creates histogram with buckets upper bounds
+//
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+//
+// Observe adds value to histogram
+//
+func (h *Histogram) Observe(value float64) {
+
+	i := sort.SearchFloat64s(h.bounds, value)
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+//
+// HistogramSnapshot is consistent copy of histogram
+//
+type HistogramSnapshot struct {
+
+	// Upper bounds and cumulative counts of buckets, without +Inf
+	Bounds []float64
+	Counts []uint64
+
+	Sum   float64
+	Count uint64
+}
+
+//
+// Snapshot returns consistent copy of histogram with cumulative counts
+//
+func (h *Histogram) Snapshot() HistogramSnapshot {
+
+	h.Lock()
+	defer h.Unlock()
+
+	snapshot := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.bounds)),
+		Sum:    h.sum,
+		Count:  h.count,
+	}
+
+	var cumulative uint64
+	for i := range h.bounds {
+		cumulative += h.counts[i]
+		snapshot.Counts[i] = cumulative
+	}
+
+	return snapshot
+}
+
+//
+// Separator of label values in keys of vectors
+//
+const labelsSeparator = "\xff"
+
+//
+// CounterVec is set of counters distinguished by label values
+//
+type CounterVec struct {
+	sync.RWMutex
+
+	Labels   []string
+	counters map[string]*Counter
+}
+
+//
+// NewCounterVec creates counters set with label names
+//
+func NewCounterVec(labels ...string) *CounterVec {
+	return &CounterVec{
+		Labels:   labels,
+		counters: map[string]*Counter{},
+	}
+}
+
+//
+// With returns counter of label values, creating it if needed
+//
+func (v *CounterVec) With(values ...string) *Counter {
+
+	key := strings.Join(values, labelsSeparator)
+
+	v.RLock()
+	counter, ok := v.counters[key]
+	v.RUnlock()
+
+	if ok {
+		return counter
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	if counter, ok = v.counters[key]; !ok {
+		counter = &Counter{}
+		v.counters[key] = counter
+	}
+
+	return counter
+}
+
+//
+// Each calls fn for every counter in order of label values
+//
+func (v *CounterVec) Each(fn func(values []string, counter *Counter)) {
+
+	v.RLock()
+	keys := make([]string, 0, len(v.counters))
+	for key := range v.counters {
+		keys = append(keys, key)
+	}
+	v.RUnlock()
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.RLock()
+		counter := v.counters[key]
+		v.RUnlock()
+		fn(strings.Split(key, labelsSeparator), counter)
+	}
+}
+
+//
+// HistogramVec is set of histograms distinguished by label values
+//
+type HistogramVec struct {
+	sync.RWMutex
+
+	Labels     []string
+	bounds     []float64
+	histograms map[string]*Histogram
+}
+
+//
+// NewHistogramVec creates histograms set with buckets and label names
+//
+func NewHistogramVec(bounds []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		Labels:     labels,
+		bounds:     bounds,
+		histograms: map[string]*Histogram{},
+	}
+}
+
+//
+// With returns histogram of label values, creating it if needed
+//
+func (v *HistogramVec) With(values ...string) *Histogram {
+
+	key := strings.Join(values, labelsSeparator)
+
+	v.RLock()
+	histogram, ok := v.histograms[key]
+	v.RUnlock()
+
+	if ok {
+		return histogram
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	if histogram, ok = v.histograms[key]; !ok {
+		histogram = NewHistogram(v.bounds)
+		v.histograms[key] = histogram
+	}
+
+	return histogram
+}
+
+//
+// Each calls fn for every histogram in order of label values
+//
+func (v *HistogramVec) Each(fn func(values []string, histogram *Histogram)) {
+
+	v.RLock()
+	keys := make([]string, 0, len(v.histograms))
+	for key := range v.histograms {
+		keys = append(keys, key)
+	}
+	v.RUnlock()
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.RLock()
+		histogram := v.histograms[key]
+		v.RUnlock()
+		fn(strings.Split(key, labelsSeparator), histogram)
+	}
+}
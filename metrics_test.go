@@ -0,0 +1,88 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"context"
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/format"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+	var client *Connection
+
+	go (func() {
+
+		defer close(ready)
+
+		var err error
+		client, err = NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("echo", func(req *api.Request, res *api.Response) {
+			res.Done(nil)
+		})
+
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	if err != nil || client == nil {
+		t.Fatal("Expected connections", err)
+	}
+
+	if res, _ := server.Call("echo", nil).Next(); !res.IsDone() {
+		t.Fatal("Expected done response")
+	}
+
+	m := server.Metrics()
+
+	if v := m.RequestsOut.With("echo", "done").Value(); v != 1 {
+		t.Fatal("Expected 1 finished request, got", v)
+	}
+
+	if v := m.Pending.Value(); v != 0 {
+		t.Fatal("Expected no pending requests, got", v)
+	}
+
+	if m.FramesOut.With("request").Value() != 1 || m.FramesIn.With("response").Value() != 1 {
+		t.Fatal("Expected request and response frames to be counted")
+	}
+
+	if m.BytesIn.Value() == 0 || m.BytesOut.Value() == 0 {
+		t.Fatal("Expected bytes to be counted")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for client.Metrics().RequestsIn.With("echo", "done").Value() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected handled request to be counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := server.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := m.PingRtt.Snapshot(); s.Count != 1 {
+		t.Fatal("Expected ping rtt to be observed, got", s.Count)
+	}
+}
@@ -0,0 +1,315 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/dealers"
+	"github.com/yyyar/yamp-go/ids"
+	"github.com/yyyar/yamp-go/logging"
+	"github.com/yyyar/yamp-go/parser"
+	"github.com/yyyar/yamp-go/trace"
+	"io"
+	"time"
+)
+
+const (
+
+	// Default body of automatic error response
+	DEFAULT_NO_RESPONSE_ERROR = "Request handler returned without response"
+
+	// Default number of progress responses responder may send
+	// before requester consumes them (when flow control is on)
+	DEFAULT_PROGRESS_WINDOW = 64
+
+	// Default max size of fragment of large frame
+	DEFAULT_FRAGMENT_SIZE = 64 * 1024
+
+	// Default size of body chunks read from io.Reader
+	DEFAULT_CHUNK_SIZE = 64 * 1024
+
+	// Default max size of incoming frame, including reassembled ones
+	DEFAULT_MAX_FRAME_SIZE = 32 * 1024 * 1024
+
+	// Default max size of incoming frame body
+	DEFAULT_MAX_BODY_SIZE = 16 * 1024 * 1024
+
+	// Default max number of incoming fragmented frames
+	// being reassembled at once
+	DEFAULT_MAX_PARTIAL_FRAMES = 16
+
+	// Default number of body chunks requester may send
+	// before responder consumes them (when flow control is on)
+	DEFAULT_CHUNK_WINDOW = 16
+
+	// Default max number of bytes written to transport at once
+	DEFAULT_WRITE_BATCH_SIZE = 64 * 1024
+)
+
+//
+// Options are optional Connection settings.
+// Zero value of every field means default behavior
+//
+type Options struct {
+
+	// Send error response on behalf of request handler that returned
+	// without terminal response, and ErrNoHandler to requests there is
+	// no handler for. Off by default, since handlers may respond
+	// asynchronously after they return. Streaming requests without
+	// handler get ErrNoHandler anyway
+	EnableNoResponseError bool
+
+	// Body of automatic error response, see EnableNoResponseError.
+	// Defaults to DEFAULT_NO_RESPONSE_ERROR
+	NoResponseError interface{}
+
+	// Highest protocol version to offer in handshake. Defaults to
+	// YAMP_VERSION, set to lower version to talk to servers not aware
+	// of newer ones (1 is the original protocol)
+	Version uint16
+
+	// Do not negotiate flow control of progress responses
+	DisableFlowControl bool
+
+	// Do not negotiate streaming requests
+	DisableRequestStreaming bool
+
+	// Do not negotiate metadata headers of user frames
+	DisableMetadata bool
+
+	// Do not negotiate acknowledged events
+	DisableEventAcks bool
+
+	// Do not negotiate fragmentation of large frames
+	DisableFragmentation bool
+
+	// Frames serialized to more than this number of bytes are sent
+	// in fragments of this size. Defaults to DEFAULT_FRAGMENT_SIZE
+	FragmentSize int
+
+	// Size of body chunks SendRequestStream reads and sends.
+	// Defaults to DEFAULT_CHUNK_SIZE
+	ChunkSize int
+
+	// Max size of incoming frame in bytes. Other party sending larger
+	// frame gets disconnected. Defaults to DEFAULT_MAX_FRAME_SIZE
+	MaxFrameSize uint32
+
+	// Max size of incoming frame body in bytes. Defaults to DEFAULT_MAX_BODY_SIZE
+	MaxBodySize uint32
+
+	// Max number of incoming fragmented frames being reassembled at once.
+	// Other party exceeding it gets disconnected. Defaults to DEFAULT_MAX_PARTIAL_FRAMES
+	MaxPartialFrames uint32
+
+	// Outgoing frames are coalesced and written to transport in batches
+	// of up to this number of bytes. Defaults to DEFAULT_WRITE_BATCH_SIZE,
+	// set to 1 to write every frame separately
+	WriteBatchSize int
+
+	// Logger of connection events and dropped frames. Messages get
+	// connection id field. Defaults to logging.Default
+	Logger logging.Logger
+
+	// Optional tracer of handlers execution and outgoing calls.
+	// Trace context is propagated if metadata headers are negotiated
+	Tracer *trace.Tracer
+
+	// Max time frame may wait in batch for more frames to come. By default
+	// batch is written as soon as there are no more frames queued
+	WriteMaxLatency time.Duration
+
+	// Number of progress responses responder is allowed to send ahead
+	// of requester consuming them. Defaults to DEFAULT_PROGRESS_WINDOW
+	ProgressWindow uint32
+
+	// Number of body chunks of streaming request requester is allowed to
+	// send ahead of handler consuming them. Defaults to DEFAULT_CHUNK_WINDOW
+	ChunkWindow uint32
+
+	// Optional hooks seeing every received and sent frame, including
+	// handshake. See Connection.OnFrameIn and Connection.OnFrameOut
+	OnFrameIn  api.FrameHandler
+	OnFrameOut api.FrameHandler
+
+	// Generator of uids of sent frames. Defaults to ids.Default,
+	// which creates random UUIDs v4
+	IdGenerator ids.Generator
+
+	// Time request without deadline waits for terminal response before
+	// it is finished with error response. By default requests never expire
+	RequestTTL time.Duration
+
+	// Max number of requests waiting for terminal response. Sending
+	// more blocks until some are finished, or their deadline passes.
+	// By default number of requests is not limited
+	MaxPendingRequests int
+
+	// Sending request over MaxPendingRequests limit fails
+	// with ErrTooManyPending rather than blocks
+	FailOnPendingLimit bool
+
+	// Outbox of acked events, shared by connections replacing each
+	// other to redeliver events sent over broken ones. By default
+	// connection has its own outbox, failing events once it is closed
+	Outbox *Outbox
+
+	// Spool of events and requests sent while there is no connection,
+	// shared by connections replacing each other. See OpenSpool
+	Spool *Spool
+
+	// Optional deduplication of incoming events and requests by uid, see
+	// dealers.NewDedup. Its window should be positive, otherwise nothing
+	// is deduplicated. May be shared by connections replacing each other
+	Dedup *dealers.Dedup
+
+	// Optional handler of connection state transitions, including
+	// ones during handshake. See Connection.OnStateChange
+	OnStateChange StateHandler
+
+	// Pretty print every received and sent frame to this writer
+	// for wire debugging. See FrameDumper
+	Debug io.Writer
+}
+
+//
+// Protocol version to offer
+//
+func (o *Options) version() uint16 {
+
+	if o.Version == 0 || o.Version > YAMP_VERSION {
+		return YAMP_VERSION
+	}
+
+	return o.Version
+}
+
+//
+// Protocol features to offer
+//
+func (o *Options) features() uint32 {
+
+	var features uint32
+
+	if !o.DisableFlowControl {
+		features |= parser.FEATURE_FLOW_CONTROL
+	}
+
+	if !o.DisableRequestStreaming {
+		features |= parser.FEATURE_REQUEST_STREAMING
+	}
+
+	if !o.DisableFragmentation {
+		features |= parser.FEATURE_FRAGMENTATION
+	}
+
+	if !o.DisableMetadata {
+		features |= parser.FEATURE_METADATA
+	}
+
+	if !o.DisableEventAcks {
+		features |= parser.FEATURE_EVENT_ACKS
+	}
+
+	return features
+}
+
+//
+// Progress window granted for every request
+//
+func (o *Options) progressWindow() uint32 {
+
+	if o.ProgressWindow == 0 {
+		return DEFAULT_PROGRESS_WINDOW
+	}
+
+	return o.ProgressWindow
+}
+
+//
+// Credit granted for body chunks of every streaming request
+//
+func (o *Options) chunkWindow() uint32 {
+
+	if o.ChunkWindow == 0 {
+		return DEFAULT_CHUNK_WINDOW
+	}
+
+	return o.ChunkWindow
+}
+
+//
+// Max size of fragment of large frame
+//
+func (o *Options) fragmentSize() int {
+
+	if o.FragmentSize <= 0 {
+		return DEFAULT_FRAGMENT_SIZE
+	}
+
+	return o.FragmentSize
+}
+
+//
+// Size of body chunks read from io.Reader
+//
+func (o *Options) chunkSize() int {
+
+	if o.ChunkSize <= 0 {
+		return DEFAULT_CHUNK_SIZE
+	}
+
+	return o.ChunkSize
+}
+
+//
+// Size limits of incoming frames
+//
+func (o *Options) limits() parser.Limits {
+
+	limits := parser.Limits{
+		MaxFrameSize:     o.MaxFrameSize,
+		MaxBodySize:      o.MaxBodySize,
+		MaxPartialFrames: o.MaxPartialFrames,
+	}
+
+	if limits.MaxFrameSize == 0 {
+		limits.MaxFrameSize = DEFAULT_MAX_FRAME_SIZE
+	}
+
+	if limits.MaxBodySize == 0 {
+		limits.MaxBodySize = DEFAULT_MAX_BODY_SIZE
+	}
+
+	if limits.MaxPartialFrames == 0 {
+		limits.MaxPartialFrames = DEFAULT_MAX_PARTIAL_FRAMES
+	}
+
+	return limits
+}
+
+//
+// Max number of bytes written to transport at once
+//
+func (o *Options) writeBatchSize() int {
+
+	if o.WriteBatchSize <= 0 {
+		return DEFAULT_WRITE_BATCH_SIZE
+	}
+
+	return o.WriteBatchSize
+}
+
+//
+// Logger of connection
+//
+func (o *Options) logger() logging.Logger {
+
+	if o.Logger == nil {
+		return logging.Default
+	}
+
+	return o.Logger
+}
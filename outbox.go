@@ -0,0 +1,226 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"github.com/satori/go.uuid"
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/parser"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+
+	// Time to wait for ack before acked event is retransmitted
+	DEFAULT_ACK_TIMEOUT = 5 * time.Second
+)
+
+//
+// Outbox keeps acked events until other party confirms them, and
+// retransmits them on timeout or over new connection. Share one outbox
+// between connections replacing each other (Options.Outbox) to redeliver
+// events sent over broken ones. Other party may get event more than once
+//
+type Outbox struct {
+	lock sync.Mutex
+
+	// Time to wait for ack before retransmit. Defaults to DEFAULT_ACK_TIMEOUT
+	Timeout time.Duration
+
+	// Unconfirmed events by uid
+	entries map[uuid.UUID]*outboxEntry
+
+	// Sequence number of next event, to keep order of retransmits
+	seq uint64
+
+	// Connection events are sent over, nil if there is none
+	conn *Connection
+}
+
+//
+// Unconfirmed event
+//
+type outboxEntry struct {
+	seq      uint64
+	frame    *parser.AckedEvent
+	priority Priority
+	deadline time.Time
+	delivery *api.Delivery
+	timer    *time.Timer
+}
+
+//
+// NewOutbox creates empty outbox
+//
+func NewOutbox() *Outbox {
+	return &Outbox{
+		entries: make(map[uuid.UUID]*outboxEntry),
+	}
+}
+
+//
+// Pending returns number of events waiting for confirmation
+//
+func (o *Outbox) Pending() int {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return len(o.entries)
+}
+
+//
+// Add event to outbox and send it if there is connection
+//
+func (o *Outbox) add(frame *parser.AckedEvent, options *sendOptions) *api.Delivery {
+
+	entry := &outboxEntry{
+		frame:    frame,
+		priority: options.priority,
+		deadline: options.deadline,
+		delivery: api.NewDelivery(),
+	}
+
+	o.lock.Lock()
+	o.seq++
+	entry.seq = o.seq
+	o.entries[frame.Uid] = entry
+	o.schedule(entry)
+	conn := o.conn
+	o.lock.Unlock()
+
+	if conn != nil {
+		conn.lane(entry.priority) <- entry.frame
+	}
+
+	return entry.delivery
+}
+
+//
+// Schedule retransmit of event, or its failure if deadline
+// comes before. Should be called under lock
+//
+func (o *Outbox) schedule(entry *outboxEntry) {
+
+	timeout := o.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_ACK_TIMEOUT
+	}
+
+	if !entry.deadline.IsZero() {
+		if until := time.Until(entry.deadline); until < timeout {
+			timeout = until
+		}
+	}
+
+	uid := entry.frame.Uid
+	entry.timer = time.AfterFunc(timeout, func() {
+		o.retransmit(uid)
+	})
+}
+
+//
+// Retransmit unconfirmed event, or fail it if its deadline passed
+//
+func (o *Outbox) retransmit(uid uuid.UUID) {
+
+	o.lock.Lock()
+
+	entry, ok := o.entries[uid]
+	if !ok {
+		o.lock.Unlock()
+		return
+	}
+
+	if !entry.deadline.IsZero() && !time.Now().Before(entry.deadline) {
+		delete(o.entries, uid)
+		o.lock.Unlock()
+		entry.delivery.Resolve(api.ErrDeadlineExceeded)
+		return
+	}
+
+	o.schedule(entry)
+	conn := o.conn
+	o.lock.Unlock()
+
+	if conn != nil {
+		conn.lane(entry.priority) <- entry.frame
+	}
+}
+
+//
+// Confirm event acked by other party
+//
+func (o *Outbox) ack(uid uuid.UUID) {
+
+	o.lock.Lock()
+	entry, ok := o.entries[uid]
+	if ok {
+		entry.timer.Stop()
+		delete(o.entries, uid)
+	}
+	o.lock.Unlock()
+
+	if ok {
+		entry.delivery.Resolve(nil)
+	}
+}
+
+//
+// Send events over connection from now on, retransmitting
+// unconfirmed ones in order they were added
+//
+func (o *Outbox) attach(c *Connection) {
+
+	o.lock.Lock()
+
+	o.conn = c
+
+	entries := make([]*outboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		entries = append(entries, entry)
+	}
+
+	o.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	for _, entry := range entries {
+		c.lane(entry.priority) <- entry.frame
+	}
+}
+
+//
+// Stop sending events over connection
+//
+func (o *Outbox) detach(c *Connection) {
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.conn == c {
+		o.conn = nil
+	}
+}
+
+//
+// Fail all unconfirmed events
+//
+func (o *Outbox) abort(err error) {
+
+	o.lock.Lock()
+	entries := o.entries
+	o.entries = make(map[uuid.UUID]*outboxEntry)
+	o.lock.Unlock()
+
+	for _, entry := range entries {
+		entry.timer.Stop()
+		entry.delivery.Resolve(err)
+	}
+}
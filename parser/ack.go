@@ -0,0 +1,30 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+const ACK FrameType = 0x19
+
+//
+// Ack frame confirms that acked event was handled
+//
+type Ack struct {
+	EventUid [16]byte
+}
+
+func (this *Ack) GetType() FrameType {
+	return ACK
+}
+
+func (this *Ack) Parse(reader *Reader) error {
+	return reader.ReadUid(&this.EventUid)
+}
+
+func (this *Ack) Serialize(writer *Writer) error {
+
+	writer.WriteType(this.GetType())
+	writer.WriteUid(this.EventUid)
+
+	return nil
+}
@@ -0,0 +1,34 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+const ACKED_EVENT FrameType = 0x18
+
+//
+// AckedEvent frame is event receiver should confirm with Ack frame
+// once it is handled. Sender retransmits it until it is confirmed,
+// so receiver may get it more than once
+//
+type AckedEvent struct {
+	Event
+}
+
+func (this *AckedEvent) GetType() FrameType {
+	return ACKED_EVENT
+}
+
+func (this *AckedEvent) Serialize(writer *Writer) error {
+
+	writer.WriteType(this.GetType())
+
+	if err := WriteUserHeader(writer, this.UserHeader); err != nil {
+		return err
+	}
+	if err := WriteUserBody(writer, this.UserBody); err != nil {
+		return err
+	}
+
+	return nil
+}
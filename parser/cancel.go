@@ -4,11 +4,6 @@
 
 package parser
 
-import (
-	"github.com/yyyar/yamp-go/utils"
-	"io"
-)
-
 const CANCEL FrameType = 0x12
 
 //
@@ -23,29 +18,29 @@ func (this Cancel) GetType() FrameType {
 	return CANCEL
 }
 
-func (this *Cancel) Parse(buffer io.Reader) error {
+func (this *Cancel) Parse(reader *Reader) (err error) {
 
 	// UserHeader
-	header, err := ParseUserHeader(buffer)
-	if err != nil {
+	if this.UserHeader, err = ParseUserHeader(reader); err != nil {
 		return err
 	}
-	this.UserHeader = *header
 
 	// RequestUid
-	if err := utils.Parse(buffer, &this.RequestUid); err != nil {
+	if err := reader.ReadUid(&this.RequestUid); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (this *Cancel) Serialize(writer io.Writer) error {
+func (this *Cancel) Serialize(writer *Writer) error {
 
-	utils.Serialize(writer, this.GetType())
+	writer.WriteType(this.GetType())
 
-	WriteUserHeader(writer, this.UserHeader)
-	utils.Serialize(writer, this.RequestUid)
+	if err := WriteUserHeader(writer, this.UserHeader); err != nil {
+		return err
+	}
+	writer.WriteUid(this.RequestUid)
 
 	return nil
 }
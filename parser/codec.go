@@ -0,0 +1,558 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+
+	// Size of read buffer of Reader
+	READ_BUFFER_SIZE = 32 * 1024
+
+	// Initial capacity of pooled Writer buffers
+	WRITE_BUFFER_SIZE = 4 * 1024
+
+	// Max number of bytes of varint encoded length
+	MAX_VARINT_LENGTH = 5
+)
+
+//
+// LengthSize is number of bytes of fixed size length prefix
+// of variable size field, used by protocol versions before 3
+//
+type LengthSize int
+
+const (
+	LENGTH_UINT8  LengthSize = 1
+	LENGTH_UINT16 LengthSize = 2
+	LENGTH_UINT32 LengthSize = 4
+)
+
+var (
+
+	// Returned on serializing field which length does not fit its length prefix
+	ErrFieldTooLong = errors.New("Field is too long for negotiated protocol version")
+)
+
+//
+// Max length that fits fixed size length prefix
+//
+func (size LengthSize) Max() int {
+
+	switch size {
+	case LENGTH_UINT8:
+		return math.MaxUint8
+	case LENGTH_UINT16:
+		return math.MaxUint16
+	}
+
+	return math.MaxUint32
+}
+
+//
+// Reader decodes frame fields from buffered reader
+// counting bytes of current frame and enforcing limits
+//
+type Reader struct {
+	reader *bufio.Reader
+	limits Limits
+
+	// Protocol version defining encoding of lengths
+	version uint16
+
+	// Negotiated features defining optional frame parts
+	features uint32
+
+	// Bytes read since beginning of current frame
+	read uint64
+
+	// Scratch space for fixed size fields and short strings
+	scratch [256]byte
+}
+
+//
+// NewReader creates Reader on top of reader, buffering it if needed
+//
+func NewReader(reader io.Reader, limits Limits) *Reader {
+
+	buffered, ok := reader.(*bufio.Reader)
+	if !ok {
+		buffered = bufio.NewReaderSize(reader, READ_BUFFER_SIZE)
+	}
+
+	return &Reader{
+		reader: buffered,
+		limits: limits,
+	}
+}
+
+//
+// ReadFrame reads and parses single frame. Frames of unknown
+// type or exceeding limits are reported as ProtocolError
+//
+func (this *Reader) ReadFrame() (Frame, error) {
+
+	this.read = 0
+
+	frameType, err := this.ReadUint8()
+	if err != nil {
+		return nil, err
+	}
+
+	framesFactoryLock.RLock()
+	factory, ok := framesFactory[FrameType(frameType)]
+	framesFactoryLock.RUnlock()
+
+	if !ok {
+		return nil, &ProtocolError{
+			Code:    CLOSE_PROTOCOL_ERROR,
+			Message: fmt.Sprintf("Unknown frame type 0x%02x", frameType),
+		}
+	}
+
+	frame := factory()
+	if err := frame.Parse(this); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+//
+// SetVersion sets protocol version of frames read after
+//
+func (this *Reader) SetVersion(version uint16) {
+	this.version = version
+}
+
+//
+// Version returns protocol version frames are read with
+//
+func (this *Reader) Version() uint16 {
+	return this.version
+}
+
+//
+// SetFeatures sets negotiated features of frames read after
+//
+func (this *Reader) SetFeatures(features uint32) {
+	this.features = features
+}
+
+//
+// HasFeature indicates that frames are read with feature negotiated
+//
+func (this *Reader) HasFeature(feature uint32) bool {
+	return this.features&feature != 0
+}
+
+//
+// FrameSize returns number of bytes read since
+// beginning of last (or current) frame
+//
+func (this *Reader) FrameSize() uint64 {
+	return this.read
+}
+
+//
+// Read exactly len(p) bytes of current frame
+//
+func (this *Reader) readFull(p []byte) error {
+
+	if err := this.checkSize(uint32(len(p)), false); err != nil {
+		return err
+	}
+
+	return this.fill(p)
+}
+
+//
+// Read exactly len(p) bytes without checking limits
+//
+func (this *Reader) fill(p []byte) error {
+
+	n, err := io.ReadFull(this.reader, p)
+	this.read += uint64(n)
+
+	return err
+}
+
+//
+// ReadUint8 reads single byte
+//
+func (this *Reader) ReadUint8() (uint8, error) {
+
+	if err := this.checkSize(1, false); err != nil {
+		return 0, err
+	}
+
+	b, err := this.reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	this.read++
+	return b, nil
+}
+
+//
+// ReadBool reads bool encoded as single byte
+//
+func (this *Reader) ReadBool() (bool, error) {
+	b, err := this.ReadUint8()
+	return b != 0, err
+}
+
+//
+// ReadUint16 reads big endian uint16
+//
+func (this *Reader) ReadUint16() (uint16, error) {
+
+	if err := this.readFull(this.scratch[:2]); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint16(this.scratch[:2]), nil
+}
+
+//
+// ReadUint32 reads big endian uint32
+//
+func (this *Reader) ReadUint32() (uint32, error) {
+
+	if err := this.readFull(this.scratch[:4]); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(this.scratch[:4]), nil
+}
+
+//
+// ReadLength reads length prefix of variable size field: varint since
+// protocol version 3 or fixed size integer of given size before
+//
+func (this *Reader) ReadLength(size LengthSize) (uint32, error) {
+
+	if this.version < VERSION_VARINT_LENGTHS {
+		switch size {
+		case LENGTH_UINT8:
+			v, err := this.ReadUint8()
+			return uint32(v), err
+		case LENGTH_UINT16:
+			v, err := this.ReadUint16()
+			return uint32(v), err
+		}
+		return this.ReadUint32()
+	}
+
+	var length uint64
+
+	for i := 0; i < MAX_VARINT_LENGTH; i++ {
+
+		b, err := this.ReadUint8()
+		if err != nil {
+			return 0, err
+		}
+
+		length |= uint64(b&0x7f) << (7 * uint(i))
+
+		if b < 0x80 {
+			if length > math.MaxUint32 {
+				break
+			}
+			return uint32(length), nil
+		}
+	}
+
+	return 0, &ProtocolError{
+		Code:    CLOSE_PROTOCOL_ERROR,
+		Message: "Malformed varint length",
+	}
+}
+
+//
+// ReadUid reads 16 bytes identifier
+//
+func (this *Reader) ReadUid(uid *[16]byte) error {
+	return this.readFull(uid[:])
+}
+
+//
+// ReadBytes reads field of given size. Size of body
+// fields is checked against body size limit as well
+//
+func (this *Reader) ReadBytes(size uint32, isBody bool) ([]byte, error) {
+
+	if err := this.checkSize(size, isBody); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if err := this.fill(data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+//
+// ReadString reads string of given size
+//
+func (this *Reader) ReadString(size uint32) (string, error) {
+
+	if size == 0 {
+		return "", nil
+	}
+
+	// Short strings are read without intermediate allocation
+
+	if size <= uint32(len(this.scratch)) {
+		if err := this.readFull(this.scratch[:size]); err != nil {
+			return "", err
+		}
+		return string(this.scratch[:size]), nil
+	}
+
+	data, err := this.ReadBytes(size, false)
+	return string(data), err
+}
+
+//
+// Check that declared size of frame field fits into
+// limits before allocating memory for it
+//
+func (this *Reader) checkSize(size uint32, isBody bool) error {
+
+	if isBody && this.limits.MaxBodySize > 0 && size > this.limits.MaxBodySize {
+		return &ProtocolError{
+			Code:    CLOSE_FRAME_TOO_LARGE,
+			Message: fmt.Sprintf("Body of %d bytes exceeds limit of %d", size, this.limits.MaxBodySize),
+		}
+	}
+
+	if total := this.read + uint64(size); this.limits.MaxFrameSize > 0 && total > uint64(this.limits.MaxFrameSize) {
+		return &ProtocolError{
+			Code:    CLOSE_FRAME_TOO_LARGE,
+			Message: fmt.Sprintf("Frame of at least %d bytes exceeds limit of %d", total, this.limits.MaxFrameSize),
+		}
+	}
+
+	return nil
+}
+
+//
+// Writer encodes frame fields into memory buffer,
+// so whole frame can be written at once
+//
+type Writer struct {
+	buffer []byte
+
+	// Protocol version defining encoding of lengths
+	version uint16
+
+	// Negotiated features defining optional frame parts
+	features uint32
+}
+
+//
+// Pool of writers to reuse buffers between frames
+//
+var writersPool = sync.Pool{
+	New: func() interface{} {
+		return &Writer{
+			buffer: make([]byte, 0, WRITE_BUFFER_SIZE),
+		}
+	},
+}
+
+//
+// AcquireWriter takes empty Writer from pool
+//
+func AcquireWriter() *Writer {
+	return writersPool.Get().(*Writer)
+}
+
+//
+// ReleaseWriter returns Writer to pool. Its bytes should not be used after
+//
+func ReleaseWriter(writer *Writer) {
+	writer.buffer = writer.buffer[:0]
+	writer.version = 0
+	writer.features = 0
+	writersPool.Put(writer)
+}
+
+//
+// WriteFrame serializes frame and writes it to writer at once
+//
+func WriteFrame(writer io.Writer, frame Frame) error {
+
+	w := AcquireWriter()
+	defer ReleaseWriter(w)
+
+	if err := frame.Serialize(w); err != nil {
+		return err
+	}
+
+	_, err := writer.Write(w.Bytes())
+	return err
+}
+
+//
+// SetVersion sets protocol version of frames written after
+//
+func (this *Writer) SetVersion(version uint16) {
+	this.version = version
+}
+
+//
+// Version returns protocol version frames are written with
+//
+func (this *Writer) Version() uint16 {
+	return this.version
+}
+
+//
+// SetFeatures sets negotiated features of frames written after
+//
+func (this *Writer) SetFeatures(features uint32) {
+	this.features = features
+}
+
+//
+// HasFeature indicates that frames are written with feature negotiated
+//
+func (this *Writer) HasFeature(feature uint32) bool {
+	return this.features&feature != 0
+}
+
+//
+// Bytes returns serialized data
+//
+func (this *Writer) Bytes() []byte {
+	return this.buffer
+}
+
+//
+// Len returns size of serialized data
+//
+func (this *Writer) Len() int {
+	return len(this.buffer)
+}
+
+//
+// Write appends raw bytes, so Writer is io.Writer as well
+//
+func (this *Writer) Write(p []byte) (int, error) {
+	this.buffer = append(this.buffer, p...)
+	return len(p), nil
+}
+
+//
+// WriteType writes frame type
+//
+func (this *Writer) WriteType(frameType FrameType) {
+	this.buffer = append(this.buffer, byte(frameType))
+}
+
+//
+// WriteUint8 writes single byte
+//
+func (this *Writer) WriteUint8(v uint8) {
+	this.buffer = append(this.buffer, v)
+}
+
+//
+// WriteBool writes bool as single byte
+//
+func (this *Writer) WriteBool(v bool) {
+	if v {
+		this.buffer = append(this.buffer, 1)
+	} else {
+		this.buffer = append(this.buffer, 0)
+	}
+}
+
+//
+// WriteUint16 writes big endian uint16
+//
+func (this *Writer) WriteUint16(v uint16) {
+	this.buffer = append(this.buffer, byte(v>>8), byte(v))
+}
+
+//
+// WriteUint32 writes big endian uint32
+//
+func (this *Writer) WriteUint32(v uint32) {
+	this.buffer = append(this.buffer, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+//
+// WriteLength writes length prefix of variable size field: varint since
+// protocol version 3 or fixed size integer of given size before.
+// Returns ErrFieldTooLong if length does not fit
+//
+func (this *Writer) WriteLength(length int, size LengthSize) error {
+
+	if this.version >= VERSION_VARINT_LENGTHS {
+
+		if uint64(length) > math.MaxUint32 {
+			return ErrFieldTooLong
+		}
+
+		v := uint32(length)
+		for v >= 0x80 {
+			this.buffer = append(this.buffer, byte(v)|0x80)
+			v >>= 7
+		}
+		this.buffer = append(this.buffer, byte(v))
+
+		return nil
+	}
+
+	if length > size.Max() {
+		return ErrFieldTooLong
+	}
+
+	switch size {
+	case LENGTH_UINT8:
+		this.WriteUint8(uint8(length))
+	case LENGTH_UINT16:
+		this.WriteUint16(uint16(length))
+	default:
+		this.WriteUint32(uint32(length))
+	}
+
+	return nil
+}
+
+//
+// WriteUid writes 16 bytes identifier
+//
+func (this *Writer) WriteUid(uid [16]byte) {
+	this.buffer = append(this.buffer, uid[:]...)
+}
+
+//
+// WriteBytes writes raw bytes
+//
+func (this *Writer) WriteBytes(data []byte) {
+	this.buffer = append(this.buffer, data...)
+}
+
+//
+// WriteString writes string bytes
+//
+func (this *Writer) WriteString(s string) {
+	this.buffer = append(this.buffer, s...)
+}
@@ -0,0 +1,262 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+import (
+	"bytes"
+	"github.com/yyyar/yamp-go/utils"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//
+// Test every frame is parsed back to the same value
+//
+func TestCodecRoundtrip(t *testing.T) {
+
+	header := UserHeader{Uid: [16]byte{1, 2, 3}, Uri: "foo/bar"}
+	body := UserBody{Body: []byte("hello")}
+
+	frames := []Frame{
+		&SystemHandshake{Version: 2, Features: FEATURE_FRAGMENTATION},
+		&SystemPing{Ack: true, Payload: "ping"},
+		&SystemClose{Code: CLOSE_PROTOCOL_ERROR, Message: "bye"},
+		&Event{header, body},
+		&Request{header, body},
+		&Cancel{header, [16]byte{4}},
+		&Response{header, [16]byte{5}, RESPONSE_PROGRESS, body},
+		&Credit{[16]byte{6}, 42},
+		&StreamRequest{Request{header, body}},
+		&StreamChunk{header, [16]byte{7}, false, false, body},
+		&StreamChunk{header, [16]byte{7}, true, false, body},
+		&StreamChunk{header, [16]byte{7}, true, true, body},
+		&Fragment{[16]byte{8}, true, []byte{1, 2}},
+	}
+
+	writer := AcquireWriter()
+	defer ReleaseWriter(writer)
+
+	for _, frame := range frames {
+		frame.Serialize(writer)
+	}
+
+	reader := NewReader(bytes.NewReader(writer.Bytes()), Limits{})
+
+	for _, frame := range frames {
+
+		parsed, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(parsed, frame) {
+			t.Fatal("Expected", frame, "got", parsed)
+		}
+	}
+}
+
+//
+// Test metadata is transferred only when negotiated
+//
+func TestMetadata(t *testing.T) {
+
+	event := &Event{
+		UserHeader{Uri: "foo", Metadata: Metadata{"trace": "1", "tenant": "acme"}},
+		UserBody{Body: []byte("hello")},
+	}
+
+	for _, features := range []uint32{0, FEATURE_METADATA} {
+
+		writer := AcquireWriter()
+		writer.SetFeatures(features)
+
+		if err := event.Serialize(writer); err != nil {
+			t.Fatal(err)
+		}
+
+		reader := NewReader(bytes.NewReader(writer.Bytes()), Limits{})
+		reader.SetFeatures(features)
+
+		parsed, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ReleaseWriter(writer)
+
+		metadata := parsed.(*Event).Metadata
+
+		if features == 0 && metadata != nil {
+			t.Fatal("Expected no metadata when not negotiated, got", metadata)
+		}
+
+		if features != 0 && !reflect.DeepEqual(metadata, event.Metadata) {
+			t.Fatal("Expected", event.Metadata, "got", metadata)
+		}
+	}
+}
+
+//
+// Test varint lengths carry fields longer than fixed size
+// lengths allow, and older versions reject them on send
+//
+func TestVarintLengths(t *testing.T) {
+
+	uri := strings.Repeat("u", 1000)
+
+	frames := []Frame{
+		&SystemPing{Payload: strings.Repeat("p", 300)},
+		&SystemClose{Message: strings.Repeat("c", 70000)},
+		&Event{UserHeader{Uri: uri}, UserBody{Body: []byte("hello")}},
+	}
+
+	for _, frame := range frames {
+
+		writer := AcquireWriter()
+
+		if err := frame.Serialize(writer); err != ErrFieldTooLong {
+			t.Fatal("Expected field too long error for version 2, got", err)
+		}
+
+		ReleaseWriter(writer)
+	}
+
+	writer := AcquireWriter()
+	defer ReleaseWriter(writer)
+
+	writer.SetVersion(VERSION_VARINT_LENGTHS)
+
+	for _, frame := range frames {
+		if err := frame.Serialize(writer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader := NewReader(bytes.NewReader(writer.Bytes()), Limits{})
+	reader.SetVersion(VERSION_VARINT_LENGTHS)
+
+	for _, frame := range frames {
+
+		parsed, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(parsed, frame) {
+			t.Fatal("Expected", frame.GetType(), "to be parsed back")
+		}
+	}
+
+	// Length which does not end in 5 bytes
+	reader = NewReader(bytes.NewReader([]byte{byte(SYSTEM_PING), 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}), Limits{})
+	reader.SetVersion(VERSION_VARINT_LENGTHS)
+
+	if _, err := reader.ReadFrame(); err == nil {
+		t.Fatal("Expected malformed varint to fail")
+	} else if _, ok := err.(*ProtocolError); !ok {
+		t.Fatal("Expected protocol error, got", err)
+	}
+}
+
+//
+// Event frame used in benchmarks
+//
+var benchEvent = &Event{
+	UserHeader: UserHeader{
+		Uid: [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		Uri: "telemetry/temperature",
+	},
+	UserBody: UserBody{
+		Body: []byte(`{"sensor":"boiler","value":42.5}`),
+	},
+}
+
+//
+// Serialize event field by field with reflection, as it was done before
+//
+func serializeEventReflection(writer io.Writer, event *Event) {
+	utils.Serialize(writer, event.GetType())
+	utils.Serialize(writer, event.Uid)
+	utils.Serialize(writer, uint8(len(event.Uri)))
+	utils.Serialize(writer, []byte(event.Uri))
+	utils.Serialize(writer, uint32(len(event.Body)))
+	utils.Serialize(writer, event.Body)
+}
+
+//
+// Parse event field by field with reflection, as it was done before
+//
+func parseEventReflection(reader io.Reader) *Event {
+
+	event := &Event{}
+
+	var frameType FrameType
+	utils.Parse(reader, &frameType)
+	utils.Parse(reader, &event.Uid)
+
+	var uriSize uint8
+	utils.Parse(reader, &uriSize)
+	uri := make([]byte, uriSize)
+	utils.Parse(reader, &uri)
+	event.Uri = string(uri)
+
+	var bodySize uint32
+	utils.Parse(reader, &bodySize)
+	event.Body = make([]byte, bodySize)
+	utils.Parse(reader, &event.Body)
+
+	return event
+}
+
+func BenchmarkSerializeEvent(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		WriteFrame(ioutil.Discard, benchEvent)
+	}
+}
+
+func BenchmarkSerializeEventReflection(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		serializeEventReflection(ioutil.Discard, benchEvent)
+	}
+}
+
+func BenchmarkParseEvent(b *testing.B) {
+
+	writer := AcquireWriter()
+	for i := 0; i < b.N; i++ {
+		benchEvent.Serialize(writer)
+	}
+
+	reader := NewReader(bytes.NewReader(writer.Bytes()), Limits{})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		reader.ReadFrame()
+	}
+}
+
+func BenchmarkParseEventReflection(b *testing.B) {
+
+	var buffer bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		serializeEventReflection(&buffer, benchEvent)
+	}
+
+	reader := bytes.NewReader(buffer.Bytes())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		parseEventReflection(reader)
+	}
+}
@@ -0,0 +1,45 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+const CREDIT FrameType = 0x14
+
+//
+// Credit frame grants responder permission to send
+// more progress responses for request (flow control)
+//
+type Credit struct {
+	RequestUid [16]byte
+	Credit     uint32
+}
+
+func (this *Credit) GetType() FrameType {
+	return CREDIT
+}
+
+func (this *Credit) Parse(reader *Reader) (err error) {
+
+	// RequestUid
+	if err := reader.ReadUid(&this.RequestUid); err != nil {
+		return err
+	}
+
+	// Credit
+	if this.Credit, err = reader.ReadUint32(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (this *Credit) Serialize(writer *Writer) error {
+
+	writer.WriteType(this.GetType())
+
+	writer.WriteUid(this.RequestUid)
+	writer.WriteUint32(this.Credit)
+
+	return nil
+}
@@ -0,0 +1,18 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+//
+// ProtocolError is returned by parser when other party
+// violates protocol. Connection should be closed with Code
+//
+type ProtocolError struct {
+	Code    CloseCode
+	Message string
+}
+
+func (this *ProtocolError) Error() string {
+	return this.Message
+}
@@ -4,11 +4,6 @@
 
 package parser
 
-import (
-	"github.com/yyyar/yamp-go/utils"
-	"io"
-)
-
 const EVENT FrameType = 0x10
 
 //
@@ -23,31 +18,31 @@ func (this *Event) GetType() FrameType {
 	return EVENT
 }
 
-func (this *Event) Parse(buffer io.Reader) error {
+func (this *Event) Parse(reader *Reader) (err error) {
 
 	// UserHeader
-	header, err := ParseUserHeader(buffer)
-	if err != nil {
+	if this.UserHeader, err = ParseUserHeader(reader); err != nil {
 		return err
 	}
-	this.UserHeader = *header
 
 	// UserBody
-	body, err := ParseUserBody(buffer)
-	if err != nil {
+	if this.UserBody, err = ParseUserBody(reader); err != nil {
 		return err
 	}
-	this.UserBody = *body
 
 	return nil
 }
 
-func (this *Event) Serialize(writer io.Writer) error {
+func (this *Event) Serialize(writer *Writer) error {
 
-	utils.Serialize(writer, this.GetType())
+	writer.WriteType(this.GetType())
 
-	WriteUserHeader(writer, this.UserHeader)
-	WriteUserBody(writer, this.UserBody)
+	if err := WriteUserHeader(writer, this.UserHeader); err != nil {
+		return err
+	}
+	if err := WriteUserBody(writer, this.UserBody); err != nil {
+		return err
+	}
 
 	return nil
 }
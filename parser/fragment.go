@@ -0,0 +1,62 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+const FRAGMENT FrameType = 0x17
+
+//
+// Fragment frame carries part of serialized frame that
+// is too large to be sent at once. Fragments of single
+// frame share FrameUid and may interleave with other frames
+//
+type Fragment struct {
+	FrameUid [16]byte
+	Last     bool
+	Data     []byte
+}
+
+func (this *Fragment) GetType() FrameType {
+	return FRAGMENT
+}
+
+func (this *Fragment) Parse(reader *Reader) (err error) {
+
+	// FrameUid
+	if err := reader.ReadUid(&this.FrameUid); err != nil {
+		return err
+	}
+
+	// Last
+	if this.Last, err = reader.ReadBool(); err != nil {
+		return err
+	}
+
+	// size of Data
+	size, err := reader.ReadLength(LENGTH_UINT32)
+	if err != nil {
+		return err
+	}
+
+	// Data
+	if this.Data, err = reader.ReadBytes(size, false); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (this *Fragment) Serialize(writer *Writer) error {
+
+	writer.WriteType(this.GetType())
+
+	writer.WriteUid(this.FrameUid)
+	writer.WriteBool(this.Last)
+	if err := writer.WriteLength(len(this.Data), LENGTH_UINT32); err != nil {
+		return err
+	}
+	writer.WriteBytes(this.Data)
+
+	return nil
+}
@@ -0,0 +1,20 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+//
+// Limits are size caps applied while parsing. Zero means no limit
+//
+type Limits struct {
+
+	// Max size of single frame in bytes, including type byte
+	MaxFrameSize uint32
+
+	// Max size of user frame body in bytes
+	MaxBodySize uint32
+
+	// Max number of fragmented frames being reassembled at once
+	MaxPartialFrames uint32
+}
@@ -0,0 +1,155 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+import (
+	"strconv"
+	"time"
+)
+
+//
+// Metadata header carrying relative deadline of request in milliseconds
+//
+const TIMEOUT_HEADER = "yamp-timeout"
+
+//
+// Metadata is key/value headers of user frame, such as trace ids,
+// auth tokens or content type. Transferred only if FEATURE_METADATA
+// was negotiated in handshake
+//
+type Metadata map[string]string
+
+//
+// Get returns value of key, empty if there is no such key
+//
+func (m Metadata) Get(key string) string {
+	return m[key]
+}
+
+//
+// With returns copy of metadata with key set to value
+//
+func (m Metadata) With(key, value string) Metadata {
+
+	metadata := Metadata{key: value}
+
+	for k, v := range m {
+		if k != key {
+			metadata[k] = v
+		}
+	}
+
+	return metadata
+}
+
+//
+// WithTimeout returns copy of metadata with relative deadline set,
+// rounded up to milliseconds
+//
+func (m Metadata) WithTimeout(timeout time.Duration) Metadata {
+
+	ms := (timeout + time.Millisecond - 1) / time.Millisecond
+
+	return m.With(TIMEOUT_HEADER, strconv.FormatInt(int64(ms), 10))
+}
+
+//
+// Timeout returns relative deadline of request, if set
+//
+func (m Metadata) Timeout() (time.Duration, bool) {
+
+	value, ok := m[TIMEOUT_HEADER]
+	if !ok {
+		return 0, false
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+//
+// CheckMetadata returns ErrFieldTooLong if metadata does not fit into
+// fixed size length prefixes of protocol versions before varint lengths
+//
+func CheckMetadata(version uint16, metadata Metadata) error {
+
+	if version >= VERSION_VARINT_LENGTHS {
+		return nil
+	}
+
+	if len(metadata) > LENGTH_UINT16.Max() {
+		return ErrFieldTooLong
+	}
+
+	for key, value := range metadata {
+		if len(key) > LENGTH_UINT8.Max() || len(value) > LENGTH_UINT16.Max() {
+			return ErrFieldTooLong
+		}
+	}
+
+	return nil
+}
+
+func ParseMetadata(reader *Reader) (Metadata, error) {
+
+	// number of entries
+	count, err := reader.ReadLength(LENGTH_UINT16)
+	if err != nil || count == 0 {
+		return nil, err
+	}
+
+	metadata := Metadata{}
+
+	for i := uint32(0); i < count; i++ {
+
+		// key
+		size, err := reader.ReadLength(LENGTH_UINT8)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := reader.ReadString(size)
+		if err != nil {
+			return nil, err
+		}
+
+		// value
+		if size, err = reader.ReadLength(LENGTH_UINT16); err != nil {
+			return nil, err
+		}
+
+		if metadata[key], err = reader.ReadString(size); err != nil {
+			return nil, err
+		}
+	}
+
+	return metadata, nil
+}
+
+func WriteMetadata(writer *Writer, metadata Metadata) error {
+
+	if err := writer.WriteLength(len(metadata), LENGTH_UINT16); err != nil {
+		return err
+	}
+
+	for key, value := range metadata {
+
+		if err := writer.WriteLength(len(key), LENGTH_UINT8); err != nil {
+			return err
+		}
+		writer.WriteString(key)
+
+		if err := writer.WriteLength(len(value), LENGTH_UINT16); err != nil {
+			return err
+		}
+		writer.WriteString(value)
+	}
+
+	return nil
+}
@@ -5,8 +5,25 @@
 package parser
 
 import (
-	"github.com/yyyar/yamp-go/utils"
+	"errors"
+	"fmt"
 	"io"
+	"sync"
+)
+
+//
+// Frame types from this one and above are free
+// for extension (custom) frames
+//
+const FRAME_TYPE_EXTENSION FrameType = 0x80
+
+var (
+
+	// Returned on attempt to register frame type reserved by protocol
+	ErrReservedFrameType = errors.New("Frame type is reserved by protocol")
+
+	// Returned on attempt to register frame type twice
+	ErrFrameTypeRegistered = errors.New("Frame type is already registered")
 )
 
 //
@@ -14,6 +31,12 @@ import (
 //
 var framesFactory = map[FrameType](func() Frame){}
 
+//
+// Guards framesFactory since extension frames
+// may be registered while parsers are running
+//
+var framesFactoryLock sync.RWMutex
+
 //
 // Initialize module: add frames factory functions
 //
@@ -26,6 +49,46 @@ func init() {
 	framesFactory[REQUEST] = (func() Frame { return &Request{} })
 	framesFactory[CANCEL] = (func() Frame { return &Cancel{} })
 	framesFactory[RESPONSE] = (func() Frame { return &Response{} })
+	framesFactory[CREDIT] = (func() Frame { return &Credit{} })
+	framesFactory[STREAM_REQUEST] = (func() Frame { return &StreamRequest{} })
+	framesFactory[STREAM_CHUNK] = (func() Frame { return &StreamChunk{} })
+	framesFactory[FRAGMENT] = (func() Frame { return &Fragment{} })
+	framesFactory[ACKED_EVENT] = (func() Frame { return &AckedEvent{} })
+	framesFactory[ACK] = (func() Frame { return &Ack{} })
+}
+
+//
+// RegisterFrameType registers factory of extension frame type, so
+// parsers are able to parse it. Type should be FRAME_TYPE_EXTENSION or above
+//
+func RegisterFrameType(frameType FrameType, factory func() Frame) error {
+
+	if frameType < FRAME_TYPE_EXTENSION {
+		return ErrReservedFrameType
+	}
+
+	framesFactoryLock.Lock()
+	defer framesFactoryLock.Unlock()
+
+	if _, ok := framesFactory[frameType]; ok {
+		return ErrFrameTypeRegistered
+	}
+
+	framesFactory[frameType] = factory
+
+	return nil
+}
+
+//
+// IsFrameTypeRegistered indicates that parsers are able to parse frame type
+//
+func IsFrameTypeRegistered(frameType FrameType) bool {
+
+	framesFactoryLock.RLock()
+	defer framesFactoryLock.RUnlock()
+
+	_, ok := framesFactory[frameType]
+	return ok
 }
 
 //
@@ -33,6 +96,38 @@ func init() {
 //
 type FrameType uint8
 
+//
+// Names of protocol frame types
+//
+var frameTypeNames = map[FrameType]string{
+	SYSTEM_HANDSHAKE: "system.handshake",
+	SYSTEM_CLOSE:     "system.close",
+	SYSTEM_PING:      "system.ping",
+	EVENT:            "event",
+	REQUEST:          "request",
+	CANCEL:           "cancel",
+	RESPONSE:         "response",
+	CREDIT:           "credit",
+	STREAM_REQUEST:   "stream_request",
+	STREAM_CHUNK:     "stream_chunk",
+	FRAGMENT:         "fragment",
+	ACKED_EVENT:      "acked_event",
+	ACK:              "ack",
+}
+
+//
+// String returns name of frame type, or its hex code if it is not
+// a protocol one
+//
+func (t FrameType) String() string {
+
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%02x", uint8(t))
+}
+
 //
 // Frame is transferred frame with concrete type
 //
@@ -42,10 +137,10 @@ type Frame interface {
 	GetType() FrameType
 
 	// Parse itself from reader
-	Parse(reader io.Reader) error
+	Parse(reader *Reader) error
 
 	// Write itself to writer
-	Serialize(writer io.Writer) error
+	Serialize(writer *Writer) error
 }
 
 //
@@ -53,8 +148,8 @@ type Frame interface {
 //
 type Parser struct {
 
-	// Reader to read bytes to parse from
-	reader io.Reader
+	// Buffered reader to read frames from
+	reader *Reader
 
 	// Channel to push parsed frames
 	Frames chan Frame
@@ -67,6 +162,22 @@ type Parser struct {
 // Creates new instance of Parser and starts parsing loop
 //
 func NewParser(reader io.Reader) *Parser {
+	return NewParserWithLimits(reader, Limits{})
+}
+
+//
+// Creates new instance of Parser enforcing size limits
+// and starts parsing loop
+//
+func NewParserWithLimits(reader io.Reader, limits Limits) *Parser {
+	return NewParserFromReader(NewReader(reader, limits))
+}
+
+//
+// Creates new instance of Parser reading frames with
+// already set up Reader and starts parsing loop
+//
+func NewParserFromReader(reader *Reader) *Parser {
 
 	parser := Parser{
 		reader: reader,
@@ -100,16 +211,5 @@ func (this *Parser) loop() {
 // Parse next frame
 //
 func (this *Parser) nextFrame() (Frame, error) {
-
-	var frameType FrameType
-	if err := utils.Parse(this.reader, &frameType); err != nil {
-		return nil, err
-	}
-
-	frame := framesFactory[frameType]()
-	if err := frame.Parse(this.reader); err != nil {
-		return nil, err
-	}
-
-	return frame, nil
+	return this.reader.ReadFrame()
 }
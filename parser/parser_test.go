@@ -5,6 +5,7 @@
 package parser
 
 import (
+	"bytes"
 	"io"
 	"testing"
 )
@@ -17,7 +18,7 @@ func TestParser(t *testing.T) {
 	reader, writer := io.Pipe()
 	parser := NewParser(reader)
 
-	go (&Event{
+	go WriteFrame(writer, &Event{
 		UserHeader: UserHeader{
 			Uid: [16]byte{3, 3, 3},
 			Uri: "test",
@@ -25,7 +26,7 @@ func TestParser(t *testing.T) {
 		UserBody: UserBody{
 			Body: []byte{1, 2, 3, 4, 5},
 		},
-	}).Serialize(writer)
+	})
 
 	frame, ok := <-parser.Frames
 
@@ -58,3 +59,96 @@ func TestParser(t *testing.T) {
 	}
 
 }
+
+//
+// Test handshake carries features only since version 2
+//
+func TestHandshakeVersions(t *testing.T) {
+
+	for _, version := range []uint16{1, 2} {
+
+		reader, writer := io.Pipe()
+		parser := NewParser(reader)
+
+		go (func() {
+			WriteFrame(writer, &SystemHandshake{
+				Version:  version,
+				Features: FEATURE_FLOW_CONTROL,
+			})
+
+			// Follow with another frame to make sure nothing is left unparsed
+			WriteFrame(writer, &SystemPing{Payload: "after"})
+		})()
+
+		handshake := (<-parser.Frames).(*SystemHandshake)
+		ping := (<-parser.Frames).(*SystemPing)
+
+		expected := FEATURE_FLOW_CONTROL
+		if version < 2 {
+			expected = 0
+		}
+
+		if handshake.Version != version || handshake.Features != expected || ping.Payload != "after" {
+			t.Error("Bad handshake of version", version, handshake)
+		}
+
+		writer.Close()
+	}
+}
+
+//
+// Test unknown frames and oversized bodies are protocol errors
+//
+func TestParserProtocolErrors(t *testing.T) {
+
+	cases := []struct {
+		data []byte
+		code CloseCode
+	}{
+		// Unknown frame type
+		{[]byte{0x7f, 0, 0, 0}, CLOSE_PROTOCOL_ERROR},
+
+		// Event with uid, empty uri and body of 4GiB
+		{append(append([]byte{byte(EVENT)}, make([]byte, 17)...), 0xff, 0xff, 0xff, 0xff), CLOSE_FRAME_TOO_LARGE},
+	}
+
+	for _, c := range cases {
+
+		parser := NewParserWithLimits(bytes.NewReader(c.data), Limits{
+			MaxFrameSize: 1024,
+			MaxBodySize:  512,
+		})
+
+		if _, ok := <-parser.Frames; ok {
+			t.Fatal("Unexpected frame parsed")
+		}
+
+		err, ok := (<-parser.Error).(*ProtocolError)
+		if !ok || err.Code != c.code {
+			t.Fatal("Expected protocol error with code", c.code, "got", err)
+		}
+	}
+}
+
+//
+// Test acked event and ack frames round trip
+//
+func TestAckedEvent(t *testing.T) {
+
+	var buf bytes.Buffer
+
+	WriteFrame(&buf, &AckedEvent{Event{UserHeader: UserHeader{Uid: [16]byte{1}, Uri: "foo"}}})
+	WriteFrame(&buf, &Ack{EventUid: [16]byte{1}})
+
+	reader := NewReader(&buf, Limits{})
+
+	frame, err := reader.ReadFrame()
+	if event, ok := frame.(*AckedEvent); err != nil || !ok || event.Uri != "foo" || event.Uid != [16]byte{1} {
+		t.Fatal("Expected acked event, got", frame, err)
+	}
+
+	frame, err = reader.ReadFrame()
+	if ack, ok := frame.(*Ack); err != nil || !ok || ack.EventUid != [16]byte{1} {
+		t.Fatal("Expected ack, got", frame, err)
+	}
+}
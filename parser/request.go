@@ -4,11 +4,6 @@
 
 package parser
 
-import (
-	"github.com/yyyar/yamp-go/utils"
-	"io"
-)
-
 const REQUEST FrameType = 0x11
 
 //
@@ -23,31 +18,31 @@ func (this Request) GetType() FrameType {
 	return REQUEST
 }
 
-func (this *Request) Parse(buffer io.Reader) error {
+func (this *Request) Parse(reader *Reader) (err error) {
 
 	// UserHeader
-	header, err := ParseUserHeader(buffer)
-	if err != nil {
+	if this.UserHeader, err = ParseUserHeader(reader); err != nil {
 		return err
 	}
-	this.UserHeader = *header
 
 	// UserBody
-	body, err := ParseUserBody(buffer)
-	if err != nil {
+	if this.UserBody, err = ParseUserBody(reader); err != nil {
 		return err
 	}
-	this.UserBody = *body
 
 	return nil
 }
 
-func (this *Request) Serialize(writer io.Writer) error {
+func (this *Request) Serialize(writer *Writer) error {
 
-	utils.Serialize(writer, this.GetType())
+	writer.WriteType(this.GetType())
 
-	WriteUserHeader(writer, this.UserHeader)
-	WriteUserBody(writer, this.UserBody)
+	if err := WriteUserHeader(writer, this.UserHeader); err != nil {
+		return err
+	}
+	if err := WriteUserBody(writer, this.UserBody); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -5,8 +5,7 @@
 package parser
 
 import (
-	"github.com/yyyar/yamp-go/utils"
-	"io"
+	"fmt"
 )
 
 const RESPONSE FrameType = 0x13
@@ -20,6 +19,25 @@ const (
 	RESPONSE_CANCELLED ResponseType = 0x03
 )
 
+//
+// String returns name of response type
+//
+func (t ResponseType) String() string {
+
+	switch t {
+	case RESPONSE_DONE:
+		return "done"
+	case RESPONSE_ERROR:
+		return "error"
+	case RESPONSE_PROGRESS:
+		return "progress"
+	case RESPONSE_CANCELLED:
+		return "cancelled"
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
 //
 // Response frame
 //
@@ -34,43 +52,52 @@ func (this Response) GetType() FrameType {
 	return RESPONSE
 }
 
-func (this *Response) Parse(buffer io.Reader) error {
+func (this *Response) Parse(reader *Reader) (err error) {
 
 	// UserHeader
-	header, err := ParseUserHeader(buffer)
-	if err != nil {
+	if this.UserHeader, err = ParseUserHeader(reader); err != nil {
 		return err
 	}
-	this.UserHeader = *header
 
 	// RequestUid
-	if err := utils.Parse(buffer, &this.RequestUid); err != nil {
+	if err := reader.ReadUid(&this.RequestUid); err != nil {
 		return err
 	}
 
 	// Type
-	if err := utils.Parse(buffer, &this.Type); err != nil {
+	t, err := reader.ReadUint8()
+	if err != nil {
 		return err
 	}
+	this.Type = ResponseType(t)
+
+	if this.Type > RESPONSE_CANCELLED {
+		return &ProtocolError{
+			Code:    CLOSE_PROTOCOL_ERROR,
+			Message: fmt.Sprintf("Unknown response type 0x%02x", this.Type),
+		}
+	}
 
 	// UserBody
-	body, err := ParseUserBody(buffer)
-	if err != nil {
+	if this.UserBody, err = ParseUserBody(reader); err != nil {
 		return err
 	}
-	this.UserBody = *body
 
 	return nil
 }
 
-func (this *Response) Serialize(writer io.Writer) error {
+func (this *Response) Serialize(writer *Writer) error {
 
-	utils.Serialize(writer, this.GetType())
+	writer.WriteType(this.GetType())
 
-	WriteUserHeader(writer, this.UserHeader)
-	utils.Serialize(writer, this.RequestUid)
-	utils.Serialize(writer, this.Type)
-	WriteUserBody(writer, this.UserBody)
+	if err := WriteUserHeader(writer, this.UserHeader); err != nil {
+		return err
+	}
+	writer.WriteUid(this.RequestUid)
+	writer.WriteUint8(uint8(this.Type))
+	if err := WriteUserBody(writer, this.UserBody); err != nil {
+		return err
+	}
 
 	return nil
 }
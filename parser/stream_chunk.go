@@ -0,0 +1,87 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+const STREAM_CHUNK FrameType = 0x16
+
+//
+// Values of end marker of stream chunk
+//
+const (
+	STREAM_CHUNK_DATA    uint8 = 0x00
+	STREAM_CHUNK_END     uint8 = 0x01
+	STREAM_CHUNK_ABORTED uint8 = 0x02
+)
+
+//
+// StreamChunk frame carries next body chunk of streaming
+// request, or marks end of request stream. Aborted end means
+// requester failed to send whole body, its body then carries
+// error message
+//
+type StreamChunk struct {
+	UserHeader
+	RequestUid [16]byte
+	End        bool
+	Aborted    bool
+	UserBody
+}
+
+func (this StreamChunk) GetType() FrameType {
+	return STREAM_CHUNK
+}
+
+func (this *StreamChunk) Parse(reader *Reader) (err error) {
+
+	// UserHeader
+	if this.UserHeader, err = ParseUserHeader(reader); err != nil {
+		return err
+	}
+
+	// RequestUid
+	if err := reader.ReadUid(&this.RequestUid); err != nil {
+		return err
+	}
+
+	// End marker
+	marker, err := reader.ReadUint8()
+	if err != nil {
+		return err
+	}
+	this.End = marker != STREAM_CHUNK_DATA
+	this.Aborted = marker == STREAM_CHUNK_ABORTED
+
+	// UserBody
+	if this.UserBody, err = ParseUserBody(reader); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (this *StreamChunk) Serialize(writer *Writer) error {
+
+	writer.WriteType(this.GetType())
+
+	if err := WriteUserHeader(writer, this.UserHeader); err != nil {
+		return err
+	}
+	writer.WriteUid(this.RequestUid)
+
+	switch {
+	case this.Aborted:
+		writer.WriteUint8(STREAM_CHUNK_ABORTED)
+	case this.End:
+		writer.WriteUint8(STREAM_CHUNK_END)
+	default:
+		writer.WriteUint8(STREAM_CHUNK_DATA)
+	}
+
+	if err := WriteUserBody(writer, this.UserBody); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package parser
+
+const STREAM_REQUEST FrameType = 0x15
+
+//
+// StreamRequest frame opens request which body
+// continues in StreamChunk frames
+//
+type StreamRequest struct {
+	Request
+}
+
+func (this StreamRequest) GetType() FrameType {
+	return STREAM_REQUEST
+}
+
+func (this *StreamRequest) Serialize(writer *Writer) error {
+
+	writer.WriteType(this.GetType())
+
+	if err := WriteUserHeader(writer, this.UserHeader); err != nil {
+		return err
+	}
+	if err := WriteUserBody(writer, this.UserBody); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -5,8 +5,7 @@
 package parser
 
 import (
-	"github.com/yyyar/yamp-go/utils"
-	"io"
+	"fmt"
 )
 
 const SYSTEM_CLOSE FrameType = 0x01
@@ -18,8 +17,33 @@ const (
 	CLOSE_VERSION_NOT_SUPPORTED CloseCode = 0x01
 	CLOSE_TIMEOUT               CloseCode = 0x02
 	CLOSE_REDIRECT              CloseCode = 0x03
+	CLOSE_PROTOCOL_ERROR        CloseCode = 0x04
+	CLOSE_FRAME_TOO_LARGE       CloseCode = 0x05
 )
 
+//
+// String returns name of close code
+//
+func (c CloseCode) String() string {
+
+	switch c {
+	case CLOSE_UNKNOWN:
+		return "unknown"
+	case CLOSE_VERSION_NOT_SUPPORTED:
+		return "version_not_supported"
+	case CLOSE_TIMEOUT:
+		return "timeout"
+	case CLOSE_REDIRECT:
+		return "redirect"
+	case CLOSE_PROTOCOL_ERROR:
+		return "protocol_error"
+	case CLOSE_FRAME_TOO_LARGE:
+		return "frame_too_large"
+	}
+
+	return fmt.Sprintf("0x%02x", uint8(c))
+}
+
 //
 // SystemClose frame
 //
@@ -32,36 +56,38 @@ func (this *SystemClose) GetType() FrameType {
 	return SYSTEM_CLOSE
 }
 
-func (this *SystemClose) Parse(buffer io.Reader) error {
+func (this *SystemClose) Parse(reader *Reader) error {
 
 	// Code
-	if err := utils.Parse(buffer, &this.Code); err != nil {
+	code, err := reader.ReadUint8()
+	if err != nil {
 		return err
 	}
+	this.Code = CloseCode(code)
 
 	// size of Message
-	var size uint16
-	if err := utils.Parse(buffer, &size); err != nil {
+	size, err := reader.ReadLength(LENGTH_UINT16)
+	if err != nil {
 		return err
 	}
 
 	// Message
-	message := make([]uint8, size)
-	if err := utils.Parse(buffer, &message); err != nil {
+	if this.Message, err = reader.ReadString(size); err != nil {
 		return err
 	}
-	this.Message = string(message[:])
 
 	return nil
 }
 
-func (this *SystemClose) Serialize(writer io.Writer) error {
+func (this *SystemClose) Serialize(writer *Writer) error {
 
-	utils.Serialize(writer, this.GetType())
+	writer.WriteType(this.GetType())
 
-	utils.Serialize(writer, this.Code)
-	utils.Serialize(writer, uint16(len(this.Message)))
-	utils.Serialize(writer, []byte(this.Message))
+	writer.WriteUint8(uint8(this.Code))
+	if err := writer.WriteLength(len(this.Message), LENGTH_UINT16); err != nil {
+		return err
+	}
+	writer.WriteString(this.Message)
 
 	return nil
 }
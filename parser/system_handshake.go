@@ -4,39 +4,67 @@
 
 package parser
 
-import (
-	"github.com/yyyar/yamp-go/utils"
-	"io"
+const SYSTEM_HANDSHAKE FrameType = 0x00
+
+//
+// Protocol extensions negotiated in handshake (since version 2)
+//
+const (
+	FEATURE_FLOW_CONTROL      uint32 = 1 << 0
+	FEATURE_REQUEST_STREAMING uint32 = 1 << 1
+	FEATURE_FRAGMENTATION     uint32 = 1 << 2
+	FEATURE_METADATA          uint32 = 1 << 3
+	FEATURE_EVENT_ACKS        uint32 = 1 << 4
 )
 
-const SYSTEM_HANDSHAKE FrameType = 0x00
+//
+// Protocol version since which length prefixes of variable
+// size fields are varints instead of fixed size integers
+//
+const VERSION_VARINT_LENGTHS uint16 = 0x03
 
 //
 // SystemHandshake frame
 //
 type SystemHandshake struct {
 	Version uint16
+
+	// Bitmask of supported features, present since version 2
+	Features uint32
 }
 
 func (this *SystemHandshake) GetType() FrameType {
 	return SYSTEM_HANDSHAKE
 }
 
-func (this *SystemHandshake) Parse(buffer io.Reader) error {
+func (this *SystemHandshake) Parse(reader *Reader) (err error) {
 
 	// Version
-	if err := utils.Parse(buffer, &this.Version); err != nil {
+	if this.Version, err = reader.ReadUint16(); err != nil {
+		return err
+	}
+
+	if this.Version < 2 {
+		return nil
+	}
+
+	// Features
+	if this.Features, err = reader.ReadUint32(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (this *SystemHandshake) Serialize(writer io.Writer) error {
+func (this *SystemHandshake) Serialize(writer *Writer) error {
+
+	writer.WriteType(this.GetType())
 
-	utils.Serialize(writer, this.GetType())
+	writer.WriteUint16(this.Version)
 
-	utils.Serialize(writer, this.Version)
+	if this.Version >= 2 {
+		writer.WriteUint32(this.Features)
+	}
 
 	return nil
 }
@@ -4,11 +4,6 @@
 
 package parser
 
-import (
-	"github.com/yyyar/yamp-go/utils"
-	"io"
-)
-
 const SYSTEM_PING FrameType = 0x02
 
 //
@@ -23,36 +18,36 @@ func (this *SystemPing) GetType() FrameType {
 	return SYSTEM_PING
 }
 
-func (this *SystemPing) Parse(buffer io.Reader) error {
+func (this *SystemPing) Parse(reader *Reader) (err error) {
 
 	// ack
-	if err := utils.Parse(buffer, &this.Ack); err != nil {
+	if this.Ack, err = reader.ReadBool(); err != nil {
 		return err
 	}
 
 	// size of Payload
-	var size uint8
-	if err := utils.Parse(buffer, &size); err != nil {
+	size, err := reader.ReadLength(LENGTH_UINT8)
+	if err != nil {
 		return err
 	}
 
 	// Payload
-	payload := make([]uint8, size)
-	if err := utils.Parse(buffer, &payload); err != nil {
+	if this.Payload, err = reader.ReadString(size); err != nil {
 		return err
 	}
-	this.Payload = string(payload[:])
 
 	return nil
 }
 
-func (this *SystemPing) Serialize(writer io.Writer) error {
+func (this *SystemPing) Serialize(writer *Writer) error {
 
-	utils.Serialize(writer, this.GetType())
+	writer.WriteType(this.GetType())
 
-	utils.Serialize(writer, this.Ack)
-	utils.Serialize(writer, uint8(len(this.Payload)))
-	utils.Serialize(writer, []byte(this.Payload))
+	writer.WriteBool(this.Ack)
+	if err := writer.WriteLength(len(this.Payload), LENGTH_UINT8); err != nil {
+		return err
+	}
+	writer.WriteString(this.Payload)
 
 	return nil
 }
@@ -4,11 +4,6 @@
 
 package parser
 
-import (
-	"github.com/yyyar/yamp-go/utils"
-	"io"
-)
-
 //
 // UserBody frame part
 //
@@ -16,29 +11,30 @@ type UserBody struct {
 	Body []byte
 }
 
-func ParseUserBody(buffer io.Reader) (*UserBody, error) {
+func ParseUserBody(reader *Reader) (UserBody, error) {
 
 	message := UserBody{}
 
 	// size of Body
-	var size uint32
-	if err := utils.Parse(buffer, &size); err != nil {
-		return nil, err
+	size, err := reader.ReadLength(LENGTH_UINT32)
+	if err != nil {
+		return message, err
 	}
 
 	// Body
-	message.Body = make([]byte, size)
-	if err := utils.Parse(buffer, &message.Body); err != nil {
-		return nil, err
+	if message.Body, err = reader.ReadBytes(size, true); err != nil {
+		return message, err
 	}
 
-	return &message, nil
+	return message, nil
 }
 
-func WriteUserBody(writer io.Writer, message UserBody) error {
+func WriteUserBody(writer *Writer, message UserBody) error {
 
-	utils.Serialize(writer, uint32(len(message.Body)))
-	utils.Serialize(writer, message.Body)
+	if err := writer.WriteLength(len(message.Body), LENGTH_UINT32); err != nil {
+		return err
+	}
+	writer.WriteBytes(message.Body)
 
 	return nil
 }
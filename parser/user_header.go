@@ -4,49 +4,60 @@
 
 package parser
 
-import (
-	"github.com/yyyar/yamp-go/utils"
-	"io"
-)
-
 //
 // UserHeader frame part
 //
 type UserHeader struct {
 	Uid [16]byte
 	Uri string
+
+	// Present only if FEATURE_METADATA was negotiated
+	Metadata Metadata
 }
 
-func ParseUserHeader(buffer io.Reader) (*UserHeader, error) {
+func ParseUserHeader(reader *Reader) (UserHeader, error) {
 
 	message := UserHeader{}
 
 	// Uid
-	if err := utils.Parse(buffer, &message.Uid); err != nil {
-		return nil, err
+	if err := reader.ReadUid(&message.Uid); err != nil {
+		return message, err
 	}
 
 	// size of Uri
-	var size uint8
-	if err := utils.Parse(buffer, &size); err != nil {
-		return nil, err
+	size, err := reader.ReadLength(LENGTH_UINT8)
+	if err != nil {
+		return message, err
 	}
 
 	// Uri
-	uri := make([]uint8, size)
-	if err := utils.Parse(buffer, &uri); err != nil {
-		return nil, err
+	if message.Uri, err = reader.ReadString(size); err != nil {
+		return message, err
+	}
+
+	// Metadata
+	if reader.HasFeature(FEATURE_METADATA) {
+		if message.Metadata, err = ParseMetadata(reader); err != nil {
+			return message, err
+		}
 	}
-	message.Uri = string(uri[:])
 
-	return &message, nil
+	return message, nil
 }
 
-func WriteUserHeader(writer io.Writer, message UserHeader) error {
+func WriteUserHeader(writer *Writer, message UserHeader) error {
 
-	utils.Serialize(writer, message.Uid)
-	utils.Serialize(writer, uint8(len(message.Uri)))
-	utils.Serialize(writer, []byte(message.Uri))
+	writer.WriteUid(message.Uid)
+	if err := writer.WriteLength(len(message.Uri), LENGTH_UINT8); err != nil {
+		return err
+	}
+	writer.WriteString(message.Uri)
+
+	if writer.HasFeature(FEATURE_METADATA) {
+		if err := WriteMetadata(writer, message.Metadata); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
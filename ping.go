@@ -0,0 +1,89 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"context"
+	"github.com/yyyar/yamp-go/parser"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Ping sends ping to other party and waits for ack,
+// returning round trip time. Fails with ErrClosed unless
+// connection is open, or once it is closed meanwhile
+//
+func (c *Connection) Ping(ctx context.Context) (time.Duration, error) {
+
+	payload := strconv.FormatUint(atomic.AddUint64(&c.pingsCount, 1), 16)
+	ack := make(chan error, 1)
+
+	// Checked under lock, so stop either sees ping or ping sees closed state
+	c.pingsLock.Lock()
+	if c.State() != STATE_OPEN {
+		c.pingsLock.Unlock()
+		return 0, ErrClosed
+	}
+	c.pings[payload] = ack
+	c.pingsLock.Unlock()
+
+	defer (func() {
+		c.pingsLock.Lock()
+		delete(c.pings, payload)
+		c.pingsLock.Unlock()
+	})()
+
+	start := time.Now()
+
+	select {
+	case c.lane(priority_system) <- &parser.SystemPing{Payload: payload}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	select {
+	case err := <-ack:
+		if err != nil {
+			return 0, err
+		}
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	rtt := time.Since(start)
+	c.metrics.Ping(rtt)
+
+	return rtt, nil
+}
+
+//
+// Wake up Ping waiting for ack
+//
+func (c *Connection) pingAck(ping *parser.SystemPing) {
+
+	c.pingsLock.Lock()
+	defer c.pingsLock.Unlock()
+
+	if ack, ok := c.pings[ping.Payload]; ok {
+		ack <- nil
+		delete(c.pings, ping.Payload)
+	}
+}
+
+//
+// Fail all pings waiting for ack with error
+//
+func (c *Connection) failPings(err error) {
+
+	c.pingsLock.Lock()
+	defer c.pingsLock.Unlock()
+
+	for payload, ack := range c.pings {
+		ack <- err
+		delete(c.pings, payload)
+	}
+}
@@ -0,0 +1,209 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"context"
+	"github.com/yyyar/yamp-go/ids"
+	"github.com/yyyar/yamp-go/parser"
+	"time"
+)
+
+//
+// Priority of outgoing frames. Frames of higher priority
+// are written before any queued frames of lower priority
+//
+type Priority int
+
+const (
+	PRIORITY_LOW Priority = iota
+	PRIORITY_NORMAL
+	PRIORITY_HIGH
+
+	// Reserved for system frames (ping acks, close),
+	// they always go first
+	priority_system
+)
+
+//
+// SendOption customizes single outgoing event or request
+//
+type SendOption func(*sendOptions)
+
+//
+// Settings of single outgoing event or request
+//
+type sendOptions struct {
+	priority Priority
+	header   parser.Metadata
+	deadline time.Time
+	ctx      context.Context
+	uid      *[16]byte
+
+	// Fail at once if limit of outstanding requests is
+	// reached instead of waiting for free slot
+	noWait bool
+}
+
+//
+// WithPriority sets priority of request frames, including its body
+// chunks. Default is PRIORITY_NORMAL
+//
+func WithPriority(priority Priority) SendOption {
+	return func(o *sendOptions) {
+		if priority >= PRIORITY_LOW && priority <= PRIORITY_HIGH {
+			o.priority = priority
+		}
+	}
+}
+
+//
+// WithHeader sets metadata header of event or request.
+// Metadata headers should be negotiated in handshake
+//
+func WithHeader(key, value string) SendOption {
+	return func(o *sendOptions) {
+		if o.header == nil {
+			o.header = parser.Metadata{}
+		}
+		o.header[key] = value
+	}
+}
+
+//
+// WithUid sets uid of event or request instead of generated one.
+// Caller is responsible for its uniqueness
+//
+func WithUid(uid [16]byte) SendOption {
+	return func(o *sendOptions) {
+		o.uid = &uid
+	}
+}
+
+//
+// WithIdempotencyKey sets uid of event or request derived from key,
+// so retries of same operation carry same uid and other party
+// is able to recognize them
+//
+func WithIdempotencyKey(key string) SendOption {
+	return WithUid(ids.FromKey(key))
+}
+
+//
+// WithTimeout sets deadline of request relative to now. Requester
+// completes request with error once it passes, and responder gets
+// it in request context if metadata headers were negotiated
+//
+func WithTimeout(timeout time.Duration) SendOption {
+	return withDeadline(time.Now().Add(timeout))
+}
+
+//
+// WithContext sets deadline of request to the one of ctx and continues
+// trace carried by ctx, so deadline and trace of request being handled
+// propagate to nested calls
+//
+func WithContext(ctx context.Context) SendOption {
+
+	deadline, ok := ctx.Deadline()
+
+	return func(o *sendOptions) {
+		o.ctx = ctx
+		if ok {
+			withDeadline(deadline)(o)
+		}
+	}
+}
+
+//
+// Set deadline unless earlier one was already set
+//
+func withDeadline(deadline time.Time) SendOption {
+	return func(o *sendOptions) {
+		if o.deadline.IsZero() || deadline.Before(o.deadline) {
+			o.deadline = deadline
+		}
+	}
+}
+
+//
+// Apply send options over defaults
+//
+func newSendOptions(opts []SendOption) *sendOptions {
+
+	o := &sendOptions{
+		priority: PRIORITY_NORMAL,
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+//
+// Create write queues, one per priority
+//
+func newLanes() []chan parser.Frame {
+
+	lanes := make([]chan parser.Frame, priority_system+1)
+	for i := range lanes {
+		lanes[i] = make(chan parser.Frame)
+	}
+
+	return lanes
+}
+
+//
+// Channel of frames of given priority
+//
+func (c *Connection) lane(priority Priority) chan parser.Frame {
+	return c.lanes[priority]
+}
+
+//
+// Take next frame to write and its priority, highest priority first.
+// Lanes marked busy are skipped, so their frames keep waiting in order.
+// If block is false or deadline fires before any frame comes, returns nil frame
+//
+func (c *Connection) nextFrame(block bool, deadline <-chan time.Time, busy []bool) (parser.Frame, Priority, bool) {
+
+	// Nil channel is never ready, so busy lanes are left alone
+	lanes := c.lanes
+	if busy != nil {
+		lanes = make([]chan parser.Frame, len(c.lanes))
+		for p := range c.lanes {
+			if p >= len(busy) || !busy[p] {
+				lanes[p] = c.lanes[p]
+			}
+		}
+	}
+
+	for p := priority_system; p >= PRIORITY_LOW; p-- {
+		select {
+		case frame, ok := <-lanes[p]:
+			return frame, p, ok
+		default:
+		}
+	}
+
+	if !block {
+		return nil, PRIORITY_NORMAL, true
+	}
+
+	select {
+	case frame, ok := <-lanes[priority_system]:
+		return frame, priority_system, ok
+	case frame, ok := <-lanes[PRIORITY_HIGH]:
+		return frame, PRIORITY_HIGH, ok
+	case frame, ok := <-lanes[PRIORITY_NORMAL]:
+		return frame, PRIORITY_NORMAL, ok
+	case frame, ok := <-lanes[PRIORITY_LOW]:
+		return frame, PRIORITY_LOW, ok
+	case <-deadline:
+		return nil, PRIORITY_NORMAL, true
+	}
+}
@@ -0,0 +1,73 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"github.com/yyyar/yamp-go/parser"
+	"testing"
+)
+
+//
+// Test queued frames are taken highest priority first,
+// system frames before any user frames
+//
+func TestPriorityLanes(t *testing.T) {
+
+	c := &Connection{
+		lanes: make([]chan parser.Frame, priority_system+1),
+	}
+
+	for i := range c.lanes {
+		c.lanes[i] = make(chan parser.Frame, 1)
+	}
+
+	c.lane(PRIORITY_LOW) <- &parser.Event{UserHeader: parser.UserHeader{Uri: "low"}}
+	c.lane(PRIORITY_NORMAL) <- &parser.Event{UserHeader: parser.UserHeader{Uri: "normal"}}
+	c.lane(PRIORITY_HIGH) <- &parser.Event{UserHeader: parser.UserHeader{Uri: "high"}}
+	c.lane(priority_system) <- &parser.SystemPing{Ack: true}
+
+	if frame, _, _ := c.nextFrame(false, nil, nil); frame.GetType() != parser.SYSTEM_PING {
+		t.Fatal("Expected ping ack first, got", frame.GetType())
+	}
+
+	// Busy lane is skipped
+	busy := make([]bool, len(c.lanes))
+	busy[PRIORITY_HIGH] = true
+
+	if frame, p, _ := c.nextFrame(false, nil, busy); p != PRIORITY_NORMAL || frame.(*parser.Event).Uri != "normal" {
+		t.Fatal("Expected busy lane to be skipped, got", frame)
+	}
+
+	c.lane(PRIORITY_NORMAL) <- &parser.Event{UserHeader: parser.UserHeader{Uri: "normal"}}
+
+	for _, uri := range []string{"high", "normal", "low"} {
+		frame, _, _ := c.nextFrame(false, nil, nil)
+		if event, ok := frame.(*parser.Event); !ok || event.Uri != uri {
+			t.Fatal("Expected event", uri, "got", frame)
+		}
+	}
+
+	if frame, _, _ := c.nextFrame(false, nil, nil); frame != nil {
+		t.Fatal("Expected no frames left, got", frame)
+	}
+}
+
+//
+// Test options select priority lane
+//
+func TestSendOptionsPriority(t *testing.T) {
+
+	if p := newSendOptions(nil).priority; p != PRIORITY_NORMAL {
+		t.Fatal("Expected normal priority by default, got", p)
+	}
+
+	if p := newSendOptions([]SendOption{WithPriority(PRIORITY_HIGH)}).priority; p != PRIORITY_HIGH {
+		t.Fatal("Expected high priority, got", p)
+	}
+
+	if p := newSendOptions([]SendOption{WithPriority(priority_system)}).priority; p != PRIORITY_NORMAL {
+		t.Fatal("Expected system priority to be rejected, got", p)
+	}
+}
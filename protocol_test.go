@@ -0,0 +1,324 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"context"
+	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/parser"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+//
+// Test party violating protocol gets close frame with proper code
+//
+func TestProtocolErrorClose(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	go (func() {
+		_, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+		}
+	})()
+
+	// Handshake manually, then send garbage
+	reader := parser.NewReader(r1, parser.Limits{})
+
+	go parser.WriteFrame(w2, &parser.SystemHandshake{Version: YAMP_VERSION})
+
+	if frame, err := reader.ReadFrame(); err != nil || frame.GetType() != parser.SYSTEM_HANDSHAKE {
+		t.Fatal("Expected handshake, got", frame, err)
+	}
+
+	reader.SetVersion(YAMP_VERSION)
+
+	go w2.Write([]byte{0x7f})
+
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatal("Expected close frame, got", err)
+	}
+
+	close, ok := frame.(*parser.SystemClose)
+	if !ok || close.Code != parser.CLOSE_PROTOCOL_ERROR {
+		t.Fatal("Expected close with protocol error code, got", frame)
+	}
+}
+
+//
+// Custom frame used to test extension frames
+//
+type testExtensionFrame struct {
+	Value uint32
+}
+
+func (this *testExtensionFrame) GetType() parser.FrameType {
+	return parser.FRAME_TYPE_EXTENSION
+}
+
+func (this *testExtensionFrame) Parse(reader *parser.Reader) (err error) {
+	this.Value, err = reader.ReadUint32()
+	return err
+}
+
+func (this *testExtensionFrame) Serialize(writer *parser.Writer) error {
+	writer.WriteType(this.GetType())
+	writer.WriteUint32(this.Value)
+	return nil
+}
+
+//
+// Registry of frame types is global, so extension frame
+// is registered once even if tests run repeatedly
+//
+var (
+	registerExtension    sync.Once
+	registerExtensionErr error
+)
+
+//
+// Test custom frames registration and dispatching
+//
+func TestExtensionFrames(t *testing.T) {
+
+	factory := func() parser.Frame {
+		return &testExtensionFrame{}
+	}
+
+	registerExtension.Do(func() {
+		registerExtensionErr = parser.RegisterFrameType(parser.FRAME_TYPE_EXTENSION, factory)
+	})
+
+	if registerExtensionErr != nil {
+		t.Fatal(registerExtensionErr)
+	}
+
+	if parser.RegisterFrameType(parser.FRAME_TYPE_EXTENSION, factory) != parser.ErrFrameTypeRegistered {
+		t.Fatal("Frame type was allowed to be registered twice")
+	}
+
+	if parser.RegisterFrameType(parser.EVENT, nil) != parser.ErrReservedFrameType {
+		t.Fatal("Protocol frame type was allowed to be registered")
+	}
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	received := make(chan uint32)
+	ready := make(chan bool)
+
+	go (func() {
+
+		client, _ := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+
+		client.OnFrame(parser.FRAME_TYPE_EXTENSION, func(frame parser.Frame) {
+			received <- frame.(*testExtensionFrame).Value
+		})
+
+		ready <- true
+
+	})()
+
+	server, _ := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	if err := server.SendFrame(&parser.Event{}); err != parser.ErrReservedFrameType {
+		t.Fatal("Protocol frame was allowed to be sent as extension")
+	}
+
+	for i := uint32(0); i < 3; i++ {
+
+		server.SendFrame(&testExtensionFrame{i})
+
+		if value := <-received; value != i {
+			t.Fatal("Expected", i, "got", value)
+		}
+	}
+}
+
+//
+// Test party sending user frame before handshake gets close frame
+//
+func TestFrameBeforeHandshake(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	result := make(chan error, 1)
+	go (func() {
+		_, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+		result <- err
+	})()
+
+	go parser.WriteFrame(w2, &parser.Event{UserHeader: parser.UserHeader{Uri: "foo"}})
+
+	frame, err := parser.NewReader(r1, parser.Limits{}).ReadFrame()
+	if err != nil {
+		t.Fatal("Expected close frame, got", err)
+	}
+
+	if close, ok := frame.(*parser.SystemClose); !ok || close.Code != parser.CLOSE_PROTOCOL_ERROR {
+		t.Fatal("Expected close with protocol error code, got", frame)
+	}
+
+	if _, ok := (<-result).(*parser.ProtocolError); !ok {
+		t.Fatal("Expected protocol error of handshake")
+	}
+}
+
+//
+// Test state transitions are observable and sending
+// is rejected once connection is closing
+//
+func TestStates(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	transitions := make(chan [2]State, 8)
+	options := Options{
+		OnStateChange: func(from, to State) {
+			transitions <- [2]State{from, to}
+		},
+	}
+
+	ready := make(chan *Connection)
+
+	go (func() {
+		client, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, options)
+		if err != nil {
+			t.Error(err)
+		}
+		ready <- client
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	client := <-ready
+
+	if err != nil || client == nil {
+		t.Fatal("Expected connections", err)
+	}
+
+	if client.State() != STATE_OPEN || server.State() != STATE_OPEN {
+		t.Fatal("Expected open connections, got", client.State(), server.State())
+	}
+
+	server.Close("bye")
+
+	if server.State() < STATE_CLOSING {
+		t.Fatal("Expected server to be closing, got", server.State())
+	}
+
+	if err := server.SendEvent("foo", nil); err != ErrClosed {
+		t.Fatal("Expected ErrClosed, got", err)
+	}
+
+	for _, expected := range [][2]State{{STATE_HANDSHAKING, STATE_OPEN}, {STATE_OPEN, STATE_CLOSING}} {
+		select {
+		case transition := <-transitions:
+			if transition != expected {
+				t.Fatal("Expected transition", expected, "got", transition)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected transition", expected)
+		}
+	}
+
+	if err := client.SendEvent("foo", nil); err != ErrClosed {
+		t.Fatal("Expected ErrClosed, got", err)
+	}
+}
+
+//
+// Test ping of closing connection fails right away, and
+// ping waiting for ack fails once connection is closed
+//
+func TestPingClosed(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan *Connection)
+
+	go (func() {
+		conn, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+		}
+		ready <- conn
+	})()
+
+	// Other party handshakes but never acks pings
+	reader := parser.NewReader(r2, parser.Limits{})
+
+	if frame, err := reader.ReadFrame(); err != nil || frame.GetType() != parser.SYSTEM_HANDSHAKE {
+		t.Fatal("Expected handshake, got", frame, err)
+	}
+
+	go parser.WriteFrame(w1, &parser.SystemHandshake{Version: YAMP_VERSION})
+
+	conn := <-ready
+	if conn == nil {
+		t.Fatal("Expected connection")
+	}
+
+	go io.Copy(ioutil.Discard, r2)
+
+	failed := make(chan error)
+	go (func() {
+		_, err := conn.Ping(context.Background())
+		failed <- err
+	})()
+
+	time.Sleep(10 * time.Millisecond)
+
+	conn.Close("bye")
+
+	if _, err := conn.Ping(context.Background()); err != ErrClosed {
+		t.Fatal("Expected ping of closing connection to fail with ErrClosed, got", err)
+	}
+
+	w1.Close()
+
+	select {
+	case err := <-failed:
+		if err != ErrClosed {
+			t.Fatal("Expected waiting ping to fail with ErrClosed, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected waiting ping to fail once connection is closed")
+	}
+}
+
+//
+// Test number of frames being reassembled at once is limited
+//
+func TestPartialFramesLimit(t *testing.T) {
+
+	r := newReassembler(parser.Limits{MaxPartialFrames: 2}, YAMP_VERSION, 0)
+
+	for i := byte(0); i < 2; i++ {
+		if _, err := r.add(&parser.Fragment{FrameUid: [16]byte{i}, Data: []byte{1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fragment of frame being reassembled is fine
+	if _, err := r.add(&parser.Fragment{FrameUid: [16]byte{1}, Data: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := r.add(&parser.Fragment{FrameUid: [16]byte{2}, Data: []byte{1}})
+	if protocolErr, ok := err.(*parser.ProtocolError); !ok || protocolErr.Code != parser.CLOSE_PROTOCOL_ERROR {
+		t.Fatal("Expected protocol error, got", err)
+	}
+}
@@ -5,12 +5,23 @@
 package yamp
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/satori/go.uuid"
 	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/dealers"
 	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/ids"
+	"github.com/yyyar/yamp-go/parser"
+	"github.com/yyyar/yamp-go/trace"
 	"io"
+	"io/ioutil"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 //
@@ -123,3 +134,1289 @@ func TestProgressive(t *testing.T) {
 
 	wg.Wait()
 }
+
+//
+// Test response stream delivers progressive responses in order
+//
+func TestResponseStream(t *testing.T) {
+
+	const N = 100
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	// Run responder
+	go (func() {
+
+		defer close(ready)
+
+		client, _ := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+
+		client.OnRequest("count", func(req *api.Request, res *api.Response) {
+
+			for i := 0; i < N; i++ {
+				res.Progress(i)
+			}
+
+			res.Done(N)
+		})
+
+	})()
+
+	// Run requester
+	server, _ := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	stream := server.Call("count", nil)
+
+	for i := 0; i <= N; i++ {
+
+		res, ok := stream.Next()
+		if !ok {
+			t.Fatal("Stream ended too early at", i)
+		}
+
+		var body int
+		res.Read(&body)
+
+		if body != i {
+			t.Fatal("Expected", i, "got", body)
+		}
+
+		if res.IsProgress() != (i < N) || res.IsDone() != (i == N) {
+			t.Fatal("Wrong response type at", i)
+		}
+	}
+
+	if _, ok := stream.Next(); ok {
+		t.Fatal("Stream not finished after terminal response")
+	}
+}
+
+//
+// Test only single terminal response goes out
+// and unanswered requests are errored automatically
+//
+func TestSingleTerminalResponse(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	errs := make(chan error, 3)
+
+	// Run responder
+	go (func() {
+
+		defer close(ready)
+
+		client, _ := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			EnableNoResponseError: true,
+		})
+
+		client.OnRequest("twice", func(req *api.Request, res *api.Response) {
+			errs <- res.Done("first")
+			errs <- res.Error("second")
+			errs <- res.Progress("third")
+		})
+
+		client.OnRequest("silent", func(req *api.Request, res *api.Response) {})
+
+	})()
+
+	// Run requester
+	server, _ := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	res, _ := server.Call("twice", nil).Next()
+	if !res.IsDone() {
+		t.Fatal("First terminal response expected to win")
+	}
+
+	if err := <-errs; err != nil {
+		t.Fatal("First terminal response failed", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != api.ErrResponseFinished {
+			t.Fatal("Expected ErrResponseFinished, got", err)
+		}
+	}
+
+	res, _ = server.Call("silent", nil).Next()
+
+	var body string
+	res.Read(&body)
+
+	if !res.IsError() || body != DEFAULT_NO_RESPONSE_ERROR {
+		t.Fatal("Expected automatic error response, got", body)
+	}
+}
+
+//
+// Test handler may respond after it returned, since
+// automatic error response is off by default
+//
+func TestAsyncResponse(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	// Run responder
+	go (func() {
+
+		defer close(ready)
+
+		client, _ := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+
+		client.OnRequest("later", func(req *api.Request, res *api.Response) {
+			go (func() {
+				time.Sleep(10 * time.Millisecond)
+				res.Done("answer")
+			})()
+		})
+
+	})()
+
+	// Run requester
+	server, _ := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	res, _ := server.Call("later", nil).Next()
+
+	var body string
+	res.Read(&body)
+
+	if !res.IsDone() || body != "answer" {
+		t.Fatal("Expected asynchronous response, got", body)
+	}
+}
+
+//
+// Test bidirectional streaming: every request chunk
+// is answered with progress response
+//
+func TestRequestStreaming(t *testing.T) {
+
+	const N = 10
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	// Run responder
+	go (func() {
+
+		defer close(ready)
+
+		client, _ := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+
+		client.OnRequest("sum", func(req *api.Request, res *api.Response) {
+
+			if !req.IsStreaming() {
+				res.Error("Streaming request expected")
+				return
+			}
+
+			var sum int
+			req.Read(&sum)
+
+			for {
+				var n int
+				ok, err := req.ReadChunk(&n)
+				if !ok || err != nil {
+					break
+				}
+
+				sum += n
+				res.Progress(sum)
+			}
+
+			res.Done(sum)
+		})
+
+	})()
+
+	// Run requester
+	server, _ := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	writer, stream, err := server.CallStream("sum", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := 100
+
+	for i := 1; i <= N; i++ {
+
+		writer.Write(i)
+		expected += i
+
+		res, _ := stream.Next()
+
+		var sum int
+		res.Read(&sum)
+
+		if !res.IsProgress() || sum != expected {
+			t.Fatal("Expected progress", expected, "got", sum)
+		}
+	}
+
+	writer.Close()
+
+	if err := writer.Write(0); err != api.ErrStreamClosed {
+		t.Fatal("Expected ErrStreamClosed, got", err)
+	}
+
+	res, _ := stream.Next()
+
+	var sum int
+	res.Read(&sum)
+
+	if !res.IsDone() || sum != expected {
+		t.Fatal("Expected done", expected, "got", sum)
+	}
+}
+
+//
+// Test streaming request responder has no handler for gets error
+// response, and plain one too if automatic error responses are on
+//
+func TestNoHandler(t *testing.T) {
+
+	// Connect requester to responder without handlers
+	connect := func(options Options) *Connection {
+
+		r1, w1 := io.Pipe()
+		r2, w2 := io.Pipe()
+
+		ready := make(chan bool)
+
+		go (func() {
+			defer close(ready)
+			if _, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, options); err != nil {
+				t.Error(err)
+			}
+		})()
+
+		server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+		<-ready
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return server
+	}
+
+	// Wait for response to request, nil if there is none
+	wait := func(future *api.Future, timeout time.Duration) *api.Response {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		res, _ := future.Wait(ctx)
+		return res
+	}
+
+	isNoHandler := func(res *api.Response) bool {
+		var body string
+		res.Read(&body)
+		return res.IsError() && body == ErrNoHandler.Error()
+	}
+
+	server := connect(Options{})
+
+	writer, stream, err := server.CallStream("missing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	if res, _ := stream.Next(); res == nil || !isNoHandler(res) {
+		t.Fatal("Expected no handler error response to streaming request")
+	}
+
+	if res := wait(server.SendRequestAsync("missing", nil), 50*time.Millisecond); res != nil {
+		t.Fatal("Expected plain request not to be answered, got", res.Frame)
+	}
+
+	server = connect(Options{EnableNoResponseError: true})
+
+	if res := wait(server.SendRequestAsync("missing", nil), time.Second); res == nil || !isNoHandler(res) {
+		t.Fatal("Expected no handler error response to plain request")
+	}
+}
+
+//
+// Test request body streamed from io.Reader
+//
+func TestRequestBodyReader(t *testing.T) {
+
+	const SIZE = 1024 * 1024
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	// Run responder
+	go (func() {
+
+		defer close(ready)
+
+		client, _ := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+
+		client.OnRequest("upload", func(req *api.Request, res *api.Response) {
+
+			n, err := io.Copy(ioutil.Discard, req.BodyReader())
+			if err != nil {
+				res.Error(err.Error())
+				return
+			}
+
+			res.Done(n)
+		})
+
+	})()
+
+	// Run requester
+	server, _ := NewConnectionWithOptions(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{}, Options{
+		ChunkSize: 4096,
+	})
+	<-ready
+
+	done := make(chan int64)
+
+	err := server.SendRequestStream("upload", bytes.NewReader(make([]byte, SIZE)), func(res *api.Response) {
+		var n int64
+		res.Read(&n)
+		done <- n
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := <-done; n != SIZE {
+		t.Fatal("Expected", SIZE, "bytes uploaded, got", n)
+	}
+}
+
+//
+// failingReader returns some data, then fails
+//
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+//
+// Test body requester failed to read is not taken for whole one
+//
+func TestRequestBodyAborted(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	// Run responder
+	go (func() {
+
+		defer close(ready)
+
+		client, _ := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+
+		client.OnRequest("upload", func(req *api.Request, res *api.Response) {
+
+			n, err := io.Copy(ioutil.Discard, req.BodyReader())
+			if err != nil {
+				res.Error(err.Error())
+				return
+			}
+
+			res.Done(n)
+		})
+
+	})()
+
+	// Run requester
+	server, _ := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	done := make(chan *api.Response, 1)
+
+	err := server.SendRequestStream("upload", &failingReader{make([]byte, 100)}, func(res *api.Response) {
+		done <- res
+	})
+
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("Expected reader error, got", err)
+	}
+
+	res := <-done
+
+	var body string
+	res.Read(&body)
+
+	if !res.IsError() || body != api.ErrStreamAborted.Error() {
+		t.Fatal("Expected responder to see aborted stream, got", body)
+	}
+}
+
+//
+// Test requester can't send body chunks ahead of credit
+//
+func TestRequestStreamCredit(t *testing.T) {
+
+	const (
+		WINDOW = 2
+		N      = 10
+	)
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+	release := make(chan bool)
+
+	// Run responder
+	go (func() {
+
+		defer close(ready)
+
+		client, _ := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			ChunkWindow: WINDOW,
+		})
+
+		client.OnRequest("slow", func(req *api.Request, res *api.Response) {
+
+			<-release
+
+			count := 0
+			for {
+				var n int
+				ok, err := req.ReadChunk(&n)
+				if err != nil || !ok {
+					break
+				}
+				count++
+			}
+
+			res.Done(count)
+		})
+
+	})()
+
+	// Run requester
+	server, _ := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	writer, stream, err := server.CallStream("slow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written int32
+
+	go (func() {
+		for i := 0; i < N; i++ {
+			writer.Write(i)
+			atomic.AddInt32(&written, 1)
+		}
+		writer.Close()
+	})()
+
+	time.Sleep(50 * time.Millisecond)
+
+	if n := atomic.LoadInt32(&written); n != WINDOW {
+		t.Fatal("Expected", WINDOW, "chunks written ahead of handler, got", n)
+	}
+
+	close(release)
+
+	res, _ := stream.Next()
+
+	var count int
+	res.Read(&count)
+
+	if !res.IsDone() || count != N {
+		t.Fatal("Expected all chunks delivered, got", count)
+	}
+}
+
+//
+// Test metadata headers are delivered with requests,
+// responses and events, and only if negotiated
+//
+func TestHeaders(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+	events := make(chan string)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("echo", func(req *api.Request, res *api.Response) {
+			res.SetHeader("status", "ok")
+			res.Done(req.Header().Get("trace"))
+		})
+
+		client.OnEvent("foo", func(event *api.Event) {
+			events <- event.Header().Get("tenant")
+		})
+
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, _ := server.Call("echo", nil, WithHeader("trace", "abc")).Next()
+
+	var body string
+	res.Read(&body)
+
+	if body != "abc" || res.Header().Get("status") != "ok" {
+		t.Fatal("Expected request and response headers, got", body, res.Header())
+	}
+
+	server.SendEvent("foo", nil, WithHeader("tenant", "acme"))
+
+	if tenant := <-events; tenant != "acme" {
+		t.Fatal("Expected event header, got", tenant)
+	}
+
+	// Not negotiated
+
+	r1, w1 = io.Pipe()
+	r2, w2 = io.Pipe()
+
+	go NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+		DisableMetadata: true,
+	})
+
+	server, err = NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.SendEvent("foo", nil, WithHeader("tenant", "acme")); err != ErrNotNegotiated {
+		t.Fatal("Expected not negotiated error, got", err)
+	}
+}
+
+//
+// Test response header too long for older protocol version
+// is rejected, so terminal response still gets through
+//
+func TestLongResponseHeader(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			Version: 2,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("echo", func(req *api.Request, res *api.Response) {
+			if err := res.SetHeader(strings.Repeat("k", 300), "v"); err != parser.ErrFieldTooLong {
+				res.Error(fmt.Sprint("Expected field too long error, got ", err))
+				return
+			}
+			res.SetHeader("status", "ok")
+			res.Done(nil)
+		})
+
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	res, err := server.SendRequestAsync("echo", nil).Wait(ctx)
+	if err != nil {
+		t.Fatal("Expected terminal response, got", err)
+	}
+
+	var body string
+	res.Read(&body)
+
+	if !res.IsDone() || res.Header().Get("status") != "ok" {
+		t.Fatal("Expected response with short header, got", body, res.Header())
+	}
+}
+
+//
+// Test request deadline is propagated to responder, expired
+// requests are dropped and requester gets error once deadline passes
+//
+func TestDeadline(t *testing.T) {
+
+	const TIMEOUT = 200 * time.Millisecond
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+	cancelled := make(chan bool, 1)
+	dropped := make(chan bool, 1)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("remaining", func(req *api.Request, res *api.Response) {
+
+			deadline, ok := req.Context().Deadline()
+			if !ok {
+				res.Error("no deadline")
+				return
+			}
+
+			res.Done(time.Until(deadline) / time.Millisecond)
+		})
+
+		client.OnRequest("wait", func(req *api.Request, res *api.Response) {
+			<-req.Context().Done()
+			cancelled <- true
+		})
+
+		client.OnRequest("expired", func(req *api.Request, res *api.Response) {
+			dropped <- false
+			res.Done(nil)
+		})
+
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deadline is passed to responder context
+
+	ctx, cancel := context.WithTimeout(context.Background(), TIMEOUT)
+	defer cancel()
+
+	res, _ := server.Call("remaining", nil, WithContext(ctx)).Next()
+
+	var remaining time.Duration
+	res.Read(&remaining)
+
+	if !res.IsDone() || remaining <= 0 || remaining > TIMEOUT/time.Millisecond {
+		t.Fatal("Expected remaining time within timeout, got", remaining)
+	}
+
+	// Requester gives up and responder context is done
+
+	start := time.Now()
+	res, _ = server.Call("wait", nil, WithTimeout(TIMEOUT)).Next()
+
+	var body string
+	res.Read(&body)
+
+	if !res.IsError() || body != api.ErrDeadlineExceeded.Error() || time.Since(start) < TIMEOUT {
+		t.Fatal("Expected deadline exceeded error after timeout, got", body)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected responder context to be done")
+	}
+
+	// Expired requests are not sent or dispatched
+
+	if err := server.SendRequest("remaining", nil, func(*api.Response) {}, WithTimeout(-time.Second)); err != api.ErrDeadlineExceeded {
+		t.Fatal("Expected deadline exceeded error, got", err)
+	}
+
+	server.SendRequest("expired", nil, func(*api.Response) {}, WithHeader(parser.TIMEOUT_HEADER, "0"))
+
+	select {
+	case <-dropped:
+		t.Fatal("Expected expired request to be dropped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+//
+// testExporter collects exported spans
+//
+type testExporter chan *trace.Span
+
+func (e testExporter) Export(span *trace.Span) {
+	e <- span
+}
+
+//
+// Test trace context is propagated from client call
+// to responder and spans of both are exported
+//
+func TestTracing(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	exporter := make(testExporter, 2)
+	options := Options{
+		Tracer: trace.NewTracer(exporter),
+	}
+
+	ready := make(chan bool)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, options)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("echo", func(req *api.Request, res *api.Response) {
+			if _, ok := trace.FromContext(req.Context()); !ok {
+				res.Error("no trace")
+				return
+			}
+			res.Done(nil)
+		})
+
+	})()
+
+	server, err := NewConnectionWithOptions(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{}, options)
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res, _ := server.Call("echo", nil).Next(); !res.IsDone() {
+		t.Fatal("Expected handler to get trace context")
+	}
+
+	spans := map[trace.SpanKind]*trace.Span{}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case span := <-exporter:
+			spans[span.Kind] = span
+		case <-time.After(time.Second):
+			t.Fatal("Expected client and server spans")
+		}
+	}
+
+	client, responder := spans[trace.SPAN_KIND_CLIENT], spans[trace.SPAN_KIND_SERVER]
+
+	if client == nil || responder == nil {
+		t.Fatal("Expected client and server spans, got", spans)
+	}
+
+	if responder.Context.TraceId != client.Context.TraceId || responder.ParentId != client.Context.SpanId {
+		t.Fatal("Expected server span to be child of client span")
+	}
+
+	for _, span := range []*trace.Span{client, responder} {
+		if span.Attributes[trace.ATTRIBUTE_URI] != "echo" || span.Attributes[trace.ATTRIBUTE_RESPONSE_TYPE] != "done" {
+			t.Fatal("Unexpected span attributes", span.Attributes)
+		}
+	}
+}
+
+//
+// Test configured id generator and caller supplied uids
+//
+func TestIds(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+	uids := make(chan string, 1)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("echo", func(req *api.Request, res *api.Response) {
+			uids <- req.Id()
+			res.Done(nil)
+		})
+
+	})()
+
+	generator := ids.NewCounterGenerator()
+	server, err := NewConnectionWithOptions(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{}, Options{
+		IdGenerator: generator,
+	})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := generator.NewId()
+	expected[15]++
+
+	server.Call("echo", nil).Next()
+
+	if uid := <-uids; uid != uuid.UUID(expected).String() {
+		t.Fatal("Expected uid of generator", uuid.UUID(expected), "got", uid)
+	}
+
+	server.Call("echo", nil, WithIdempotencyKey("order-1")).Next()
+
+	if uid := <-uids; uid != uuid.UUID(ids.FromKey("order-1")).String() {
+		t.Fatal("Expected uid derived from key, got", uid)
+	}
+}
+
+//
+// Test request with uid of pending one is rejected
+// without taking slot of outstanding request
+//
+func TestDuplicateUid(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+	release := make(chan bool)
+
+	// Run responder
+	go (func() {
+
+		defer close(ready)
+
+		client, _ := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+
+		client.OnRequest("wait", func(req *api.Request, res *api.Response) {
+			<-release
+			res.Done(nil)
+		})
+
+	})()
+
+	// Run requester
+	server, _ := NewConnectionWithOptions(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{}, Options{
+		MaxPendingRequests: 2,
+		FailOnPendingLimit: true,
+	})
+	<-ready
+
+	wait := func(future *api.Future) *api.Response {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		res, err := future.Wait(ctx)
+		if err != nil {
+			t.Fatal("Expected response, got", err)
+		}
+		return res
+	}
+
+	uid := WithIdempotencyKey("once")
+	first := server.SendRequestAsync("wait", nil, uid)
+
+	if err := server.SendRequest("wait", nil, func(*api.Response) {}, uid); err != ErrDuplicateUid {
+		t.Fatal("Expected duplicate uid error, got", err)
+	}
+
+	res, _ := server.Call("wait", nil, uid).Next()
+
+	var body string
+	res.Read(&body)
+
+	if !res.IsError() || body != ErrDuplicateUid.Error() {
+		t.Fatal("Expected duplicate uid error response, got", body)
+	}
+
+	close(release)
+
+	if res := wait(first); !res.IsDone() {
+		t.Fatal("Expected original request to be answered")
+	}
+
+	// Both slots are free again
+	second := server.SendRequestAsync("wait", nil)
+	third := server.SendRequestAsync("wait", nil)
+
+	if !wait(second).IsDone() || !wait(third).IsDone() {
+		t.Fatal("Expected slots of outstanding requests to be free")
+	}
+}
+
+//
+// Test limit of outstanding requests and expiry of
+// requests that never get response
+//
+func TestPendingRequests(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+	release := make(chan bool)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("hang", func(req *api.Request, res *api.Response) {
+			<-release
+			res.Done(nil)
+		})
+
+	})()
+
+	server, err := NewConnectionWithOptions(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{}, Options{
+		RequestTTL:         100 * time.Millisecond,
+		MaxPendingRequests: 1,
+		FailOnPendingLimit: true,
+	})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer close(release)
+
+	stream := server.Call("hang", nil)
+
+	pending := server.PendingRequests()
+	if len(pending) != 1 || pending[0].Uri != "hang" || pending[0].Expires.IsZero() {
+		t.Fatal("Expected pending request with expiry, got", pending)
+	}
+
+	if err := server.SendRequest("hang", nil, func(*api.Response) {}); err != ErrTooManyPending {
+		t.Fatal("Expected ErrTooManyPending, got", err)
+	}
+
+	res, _ := stream.Next()
+
+	var body string
+	res.Read(&body)
+
+	if !res.IsError() || body != api.ErrDeadlineExceeded.Error() {
+		t.Fatal("Expected request to expire, got", res.Frame.Type, body)
+	}
+
+	if pending := server.PendingRequests(); len(pending) != 0 {
+		t.Fatal("Expected no pending requests, got", pending)
+	}
+
+	// Slot is free again
+	if err := server.SendRequest("hang", nil, func(*api.Response) {}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//
+// Test futures of requests and their combinators
+//
+func TestFutures(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+	release := make(chan bool)
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnection(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("double", func(req *api.Request, res *api.Response) {
+			var n int
+			req.Read(&n)
+			res.Progress(nil)
+			res.Done(n * 2)
+		})
+
+		client.OnRequest("hang", func(req *api.Request, res *api.Response) {
+			<-release
+			res.Done(nil)
+		})
+
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	futures := []*api.Future{}
+	for i := 0; i < 10; i++ {
+		futures = append(futures, server.SendRequestAsync("double", i))
+	}
+
+	responses, err := api.All(ctx, futures...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, res := range responses {
+		var n int
+		res.Read(&n)
+		if !res.IsDone() || n != i*2 {
+			t.Fatal("Expected done response", i*2, "got", n)
+		}
+	}
+
+	hang := server.SendRequestAsync("hang", nil)
+
+	if hang.Result() != nil {
+		t.Fatal("Expected no result of unfinished request")
+	}
+
+	i, res, err := api.Any(ctx, hang, server.SendRequestAsync("double", 1))
+	if err != nil || i != 1 || !res.IsDone() {
+		t.Fatal("Expected second future to finish first, got", i, err)
+	}
+
+	if i, _, err := api.Any(context.Background()); i != -1 || err != api.ErrNoFutures {
+		t.Fatal("Expected Any without futures to fail, got", i, err)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+
+	if _, err := hang.Wait(short); err != context.DeadlineExceeded {
+		t.Fatal("Expected wait to time out, got", err)
+	}
+}
+
+//
+// Test duplicate requests and events are handled once
+// and duplicate requests get cached response
+//
+func TestDedup(t *testing.T) {
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	ready := make(chan bool)
+	events := make(chan string, 4)
+
+	var calls int32
+
+	go (func() {
+
+		defer close(ready)
+
+		client, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			Dedup: dealers.NewDedup(time.Minute, 0),
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		client.OnRequest("count", func(req *api.Request, res *api.Response) {
+			res.Done(atomic.AddInt32(&calls, 1))
+		})
+
+		client.OnEvent("foo", func(event *api.Event) {
+			var body string
+			event.Read(&body)
+			events <- body
+		})
+
+	})()
+
+	server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+	<-ready
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+
+		res, _ := server.Call("count", nil, WithIdempotencyKey("order-1")).Next()
+
+		var n int
+		res.Read(&n)
+
+		if !res.IsDone() || n != 1 {
+			t.Fatal("Expected cached response of first call, got", n)
+		}
+	}
+
+	uid := ids.FromKey("event-1")
+
+	server.SendEvent("foo", "first", WithUid(uid))
+	server.SendEvent("foo", "duplicate", WithUid(uid))
+	server.SendEvent("foo", "second")
+
+	// Handlers run concurrently, so events may come in any order
+	got := map[string]bool{<-events: true, <-events: true}
+
+	if !got["first"] || !got["second"] {
+		t.Fatal("Expected duplicate event to be dropped, got", got)
+	}
+}
+
+//
+// Test duplicate that comes while original request is still being
+// handled gets its response once original is finished
+//
+func TestDedupInFlight(t *testing.T) {
+
+	dedup := dealers.NewDedup(time.Minute, 0)
+	started := make(chan bool, 2)
+	release := make(chan bool)
+
+	var calls int32
+
+	// Connect requester to responder sharing dedup with others
+	connect := func() *Connection {
+
+		r1, w1 := io.Pipe()
+		r2, w2 := io.Pipe()
+
+		ready := make(chan bool)
+
+		go (func() {
+
+			defer close(ready)
+
+			client, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+				Dedup: dedup,
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			client.OnRequest("count", func(req *api.Request, res *api.Response) {
+				n := atomic.AddInt32(&calls, 1)
+				started <- true
+				<-release
+				res.Done(n)
+			})
+
+		})()
+
+		server, err := NewConnection(false, &MockConnection{r2, w1}, &format.JsonBodyFormat{})
+		<-ready
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return server
+	}
+
+	first := connect().SendRequestAsync("count", nil, WithIdempotencyKey("order-1"))
+	<-started
+
+	// Retry over another connection while original is in flight
+	retry := connect().SendRequestAsync("count", nil, WithIdempotencyKey("order-1"))
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for _, future := range []*api.Future{first, retry} {
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		res, err := future.Wait(ctx)
+		cancel()
+
+		if err != nil {
+			t.Fatal("Expected response to both requests, got", err)
+		}
+
+		var n int
+		res.Read(&n)
+
+		if !res.IsDone() || n != 1 {
+			t.Fatal("Expected response of original request, got", n)
+		}
+	}
+
+	if calls != 1 {
+		t.Fatal("Expected request to be handled once, got", calls)
+	}
+}
@@ -0,0 +1,515 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/ids"
+	"github.com/yyyar/yamp-go/logging"
+	"github.com/yyyar/yamp-go/parser"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+
+	// Default max size of spool file in bytes
+	DEFAULT_SPOOL_MAX_SIZE = 64 * 1024 * 1024
+
+	// Size of spool record header: time frame was spooled,
+	// its deadline (zero if none) and priority
+	spool_header_size = 8 + 8 + 1
+)
+
+var (
+
+	// Returned when frame does not fit into spool file
+	ErrSpoolFull = errors.New("Spool is full")
+
+	// Returned by append if connection was attached meanwhile
+	errSpoolAttached = errors.New("Spool is attached to connection")
+)
+
+//
+// Spool persists outbound events and requests to local append-only
+// file while there is no open connection, and replays them in order
+// once new connection is established. Share one spool between
+// connections replacing each other (Options.Spool) and send through
+// it instead of connection. Spool is emptied only once replayed frames
+// were written, so if connection breaks during replay they are replayed
+// again over next one, and other party may get some of them twice
+//
+type Spool struct {
+	lock sync.Mutex
+
+	// Max size of spool file in bytes. Frames that don't fit are
+	// rejected with ErrSpoolFull. Defaults to DEFAULT_SPOOL_MAX_SIZE
+	MaxSize int64
+
+	// Frames spooled longer than this ago are dropped instead
+	// of being replayed. By default frames never get too old
+	MaxAge time.Duration
+
+	// Optional handler of responses to requests sent through spool
+	ResponseHandler api.ResponseHandler
+
+	// Generator of uids of spooled frames. Defaults to
+	// Options.IdGenerator of connection spool was attached to
+	// last time, or to ids.Default before first one
+	IdGenerator ids.Generator
+
+	// Format of bodies of spooled frames
+	bodyFormat format.BodyFormat
+
+	// Spool file and its size, nil once spool is closed
+	file *os.File
+	size int64
+
+	// Connection frames are sent over, nil if there is none
+	conn *Connection
+
+	// Options.IdGenerator of connection attached last time
+	generator ids.Generator
+}
+
+//
+// Spooled frame
+//
+type spoolRecord struct {
+	spooled  time.Time
+	deadline time.Time
+	priority Priority
+	frame    parser.Frame
+}
+
+//
+// OpenSpool opens spool file, creating it if it does not exist.
+// Frames spooled before are replayed over first connection
+//
+func OpenSpool(path string, bodyFormat format.BodyFormat) (*Spool, error) {
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Spool{
+		bodyFormat: bodyFormat,
+		file:       file,
+		size:       info.Size(),
+	}, nil
+}
+
+//
+// Size returns number of bytes of spooled frames
+//
+func (s *Spool) Size() int64 {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.size
+}
+
+//
+// Close closes spool file. Spooled frames are kept there
+//
+func (s *Spool) Close() error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+//
+// SendEvent sends event over connection, or spools it if there is none
+//
+func (s *Spool) SendEvent(uri string, body interface{}, opts ...SendOption) error {
+
+	for {
+
+		conn, err := s.connection()
+		if err != nil {
+			return err
+		}
+
+		if conn != nil {
+			if err := conn.SendEvent(uri, body, opts...); err != ErrClosed {
+				return err
+			}
+			s.detach(conn)
+			continue
+		}
+
+		options := newSendOptions(opts)
+		b, _ := s.bodyFormat.Serialize(body)
+
+		err = s.append(&parser.Event{
+			UserHeader: parser.UserHeader{
+				Uid:      s.uid(options),
+				Uri:      uri,
+				Metadata: options.header,
+			},
+			UserBody: parser.UserBody{
+				Body: b,
+			},
+		}, options)
+
+		if err != errSpoolAttached {
+			return err
+		}
+	}
+}
+
+//
+// SendRequest sends request over connection, or spools it if there
+// is none. Responses are passed to ResponseHandler of spool
+//
+func (s *Spool) SendRequest(uri string, body interface{}, opts ...SendOption) error {
+
+	for {
+
+		conn, err := s.connection()
+		if err != nil {
+			return err
+		}
+
+		if conn != nil {
+			if err := conn.SendRequest(uri, body, s.respond, opts...); err != ErrClosed {
+				return err
+			}
+			s.detach(conn)
+			continue
+		}
+
+		options := newSendOptions(opts)
+		b, _ := s.bodyFormat.Serialize(body)
+
+		err = s.append(&parser.Request{
+			UserHeader: parser.UserHeader{
+				Uid:      s.uid(options),
+				Uri:      uri,
+				Metadata: options.header,
+			},
+			UserBody: parser.UserBody{
+				Body: b,
+			},
+		}, options)
+
+		if err != errSpoolAttached {
+			return err
+		}
+	}
+}
+
+//
+// Connection to send frames over, nil if frames should be spooled
+//
+func (s *Spool) connection() (*Connection, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return nil, ErrClosed
+	}
+
+	return s.conn, nil
+}
+
+//
+// Uid of spooled frame, either supplied by caller or generated
+//
+func (s *Spool) uid(options *sendOptions) [16]byte {
+
+	if options.uid != nil {
+		return *options.uid
+	}
+
+	if s.IdGenerator != nil {
+		return ids.Generate(s.IdGenerator)
+	}
+
+	s.lock.Lock()
+	generator := s.generator
+	s.lock.Unlock()
+
+	return ids.Generate(generator)
+}
+
+//
+// Pass response to ResponseHandler, if there is one
+//
+func (s *Spool) respond(response *api.Response) {
+	if s.ResponseHandler != nil {
+		s.ResponseHandler(response)
+	}
+}
+
+//
+// Append frame to spool file, unless connection is attached
+//
+func (s *Spool) append(frame parser.Frame, options *sendOptions) error {
+
+	var header [spool_header_size]byte
+
+	binary.BigEndian.PutUint64(header[0:], uint64(time.Now().UnixNano()))
+	if !options.deadline.IsZero() {
+		binary.BigEndian.PutUint64(header[8:], uint64(options.deadline.UnixNano()))
+	}
+	header[16] = byte(options.priority)
+
+	writer := parser.AcquireWriter()
+	defer parser.ReleaseWriter(writer)
+
+	writer.SetVersion(YAMP_VERSION)
+	writer.SetFeatures(parser.FEATURE_METADATA)
+	writer.Write(header[:])
+
+	if err := frame.Serialize(writer); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file == nil {
+		return ErrClosed
+	}
+
+	if s.conn != nil {
+		return errSpoolAttached
+	}
+
+	maxSize := s.MaxSize
+	if maxSize <= 0 {
+		maxSize = DEFAULT_SPOOL_MAX_SIZE
+	}
+
+	if s.size+int64(writer.Len()) > maxSize {
+		return ErrSpoolFull
+	}
+
+	n, err := s.file.Write(writer.Bytes())
+	s.size += int64(n)
+
+	return err
+}
+
+//
+// Read frames spooled past offset. Frames read before broken
+// record are returned together with error. Should be called under lock
+//
+func (s *Spool) read(offset int64) ([]*spoolRecord, error) {
+
+	buffered := bufio.NewReader(io.NewSectionReader(s.file, offset, s.size-offset))
+
+	reader := parser.NewReader(buffered, parser.Limits{
+		MaxFrameSize: DEFAULT_MAX_FRAME_SIZE,
+		MaxBodySize:  DEFAULT_MAX_BODY_SIZE,
+	})
+	reader.SetVersion(YAMP_VERSION)
+	reader.SetFeatures(parser.FEATURE_METADATA)
+
+	records := []*spoolRecord{}
+
+	for {
+
+		var header [spool_header_size]byte
+		if _, err := io.ReadFull(buffered, header[:]); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return records, err
+		}
+
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			return records, err
+		}
+
+		record := &spoolRecord{
+			spooled:  time.Unix(0, int64(binary.BigEndian.Uint64(header[0:]))),
+			priority: Priority(header[16]),
+			frame:    frame,
+		}
+
+		if deadline := binary.BigEndian.Uint64(header[8:]); deadline != 0 {
+			record.deadline = time.Unix(0, int64(deadline))
+		}
+
+		records = append(records, record)
+	}
+}
+
+//
+// Generate uids of spooled frames with generator of connection
+// being set up, unless IdGenerator of spool is set
+//
+func (s *Spool) useGenerator(generator ids.Generator) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.generator = generator
+}
+
+//
+// Replay spooled frames over connection in order they were spooled,
+// empty spool file once they were written and send frames over
+// connection from now on. Runs apart from connection setup. Frames
+// are read under lock but replayed outside of it, meanwhile new frames
+// are still spooled and replayed next round, so they don't overtake
+// older ones
+//
+func (s *Spool) attach(c *Connection) {
+
+	var offset int64
+
+	for {
+
+		s.lock.Lock()
+
+		// Other connection took over meanwhile
+		if s.file == nil || s.conn != nil {
+			s.lock.Unlock()
+			return
+		}
+
+		// Everything spooled was replayed and written
+		if offset == s.size {
+			if err := s.file.Truncate(0); err != nil {
+				c.logger.Log(logging.LEVEL_ERROR, "Failed to empty spool file", logging.F(logging.FIELD_ERROR, err))
+			}
+			s.size = 0
+			s.conn = c
+			s.lock.Unlock()
+			return
+		}
+
+		records, err := s.read(offset)
+		end := s.size
+
+		s.lock.Unlock()
+
+		if err != nil {
+			c.logger.Log(logging.LEVEL_ERROR, "Spool file is broken, dropping rest of it", logging.F(logging.FIELD_ERROR, err))
+		}
+
+		if err := c.flush(s.replayAll(c, records)...); err != nil {
+			c.logger.Log(logging.LEVEL_ERROR, "Connection failed during spool replay, keeping spool", logging.F(logging.FIELD_ERROR, err))
+			return
+		}
+
+		offset = end
+	}
+}
+
+//
+// Send spooled frames that are not too old over connection.
+// Returns priorities of lanes frames were sent to
+//
+func (s *Spool) replayAll(c *Connection, records []*spoolRecord) []Priority {
+
+	now := time.Now()
+	used := map[Priority]bool{}
+	priorities := []Priority{}
+
+	for _, record := range records {
+
+		if s.MaxAge > 0 && now.Sub(record.spooled) > s.MaxAge {
+			c.logger.Log(logging.LEVEL_WARN, "Dropping too old spooled frame", logging.F(logging.FIELD_FRAME_TYPE, record.frame.GetType().String()))
+			continue
+		}
+
+		if !record.deadline.IsZero() && !now.Before(record.deadline) {
+			c.logger.Log(logging.LEVEL_WARN, "Dropping spooled frame past its deadline", logging.F(logging.FIELD_FRAME_TYPE, record.frame.GetType().String()))
+			continue
+		}
+
+		if priority, sent := s.replay(c, record); sent && !used[priority] {
+			used[priority] = true
+			priorities = append(priorities, priority)
+		}
+	}
+
+	return priorities
+}
+
+//
+// Send spooled frame over connection. Returns priority of lane
+// it was sent to, and false if it was not sent. Requests over
+// Options.MaxPendingRequests don't wait for free slot, they
+// get ErrTooManyPending error response instead
+//
+func (s *Spool) replay(c *Connection, record *spoolRecord) (Priority, bool) {
+
+	priority := record.priority
+	if priority < PRIORITY_LOW || priority > PRIORITY_HIGH {
+		priority = PRIORITY_NORMAL
+	}
+
+	switch frame := record.frame.(type) {
+
+	case *parser.Event:
+		c.lane(priority) <- frame
+		return priority, true
+
+	case *parser.Request:
+
+		options := &sendOptions{
+			priority: priority,
+			header:   frame.Metadata,
+			deadline: record.deadline,
+			noWait:   true,
+		}
+
+		frame.Metadata = c.requestHeader(options)
+
+		if err := c.register(frame.Uid, options); err != nil {
+			s.respond(c.localError(frame, err))
+			return priority, false
+		}
+
+		c.responses.OnResponse(frame.Uid, s.respond)
+		c.sendRequest(frame, &frame.UserHeader, options)
+		return priority, true
+	}
+
+	return priority, false
+}
+
+//
+// Spool frames from now on
+//
+func (s *Spool) detach(c *Connection) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == c {
+		s.conn = nil
+	}
+}
@@ -0,0 +1,390 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/format"
+	"github.com/yyyar/yamp-go/parser"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//
+// Test frames sent while there is no connection are replayed in
+// order over new one, and spool survives reopening
+//
+func TestSpool(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "yamp-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "spool")
+
+	spool, err := OpenSpool(path, &format.JsonBodyFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := spool.SendEvent("first", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := spool.SendRequest("second", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := spool.SendEvent("expired", 3, WithTimeout(time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Spooled frames are kept in file
+	spool.Close()
+
+	if err := spool.SendEvent("closed", nil); err != ErrClosed {
+		t.Fatal("Expected closed spool to reject event, got", err)
+	}
+
+	if spool, err = OpenSpool(path, &format.JsonBodyFormat{}); err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	if spool.Size() == 0 {
+		t.Fatal("Expected spooled frames to survive reopening")
+	}
+
+	if err := spool.SendEvent("third", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := make(chan *api.Response, 1)
+	spool.ResponseHandler = func(response *api.Response) {
+		responses <- response
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	go (func() {
+		_, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			Spool: spool,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})()
+
+	// Handshake manually and check replayed frames
+	reader := parser.NewReader(r2, parser.Limits{})
+
+	if frame, err := reader.ReadFrame(); err != nil || frame.GetType() != parser.SYSTEM_HANDSHAKE {
+		t.Fatal("Expected handshake, got", frame, err)
+	}
+
+	go parser.WriteFrame(w1, &parser.SystemHandshake{Version: YAMP_VERSION})
+
+	reader.SetVersion(YAMP_VERSION)
+
+	var request *parser.Request
+
+	for _, uri := range []string{"first", "second", "third"} {
+
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch frame := frame.(type) {
+		case *parser.Event:
+			if frame.Uri != uri {
+				t.Fatal("Expected event", uri, "got", frame.Uri)
+			}
+		case *parser.Request:
+			if frame.Uri != uri {
+				t.Fatal("Expected request", uri, "got", frame.Uri)
+			}
+			request = frame
+		default:
+			t.Fatal("Unexpected frame", frame)
+		}
+	}
+
+	writer := parser.AcquireWriter()
+	writer.SetVersion(YAMP_VERSION)
+
+	(&parser.Response{
+		UserHeader: parser.UserHeader{Uri: request.Uri},
+		RequestUid: request.Uid,
+		Type:       parser.RESPONSE_DONE,
+		UserBody:   parser.UserBody{Body: []byte("5")},
+	}).Serialize(writer)
+
+	go w1.Write(writer.Bytes())
+
+	select {
+	case response := <-responses:
+		var n int
+		response.Read(&n)
+		if !response.IsDone() || n != 5 {
+			t.Fatal("Unexpected response", response.Frame, n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected response to spooled request")
+	}
+
+	waitSpoolEmpty(t, spool)
+
+	// Connection is up, so event goes directly
+	go spool.SendEvent("fourth", nil)
+
+	if frame, err := reader.ReadFrame(); err != nil || frame.(*parser.Event).Uri != "fourth" {
+		t.Fatal("Expected event sent over connection, got", frame, err)
+	}
+}
+
+//
+// Test spool rejects frames over its size
+//
+func TestSpoolFull(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "yamp-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(filepath.Join(dir, "spool"), &format.JsonBodyFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	spool.MaxSize = 100
+
+	if err := spool.SendEvent("small", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := spool.SendEvent("large", string(make([]byte, 100))); err != ErrSpoolFull {
+		t.Fatal("Expected spool to be full, got", err)
+	}
+}
+
+//
+// Generator always returning the same id
+//
+type fixedGenerator [16]byte
+
+func (g fixedGenerator) NewId() [16]byte {
+	return g
+}
+
+//
+// Test spool is kept if connection breaks during replay, and frames
+// spooled meanwhile get uids of generator of connection
+//
+func TestSpoolReplayFailed(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "yamp-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(filepath.Join(dir, "spool"), &format.JsonBodyFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	if err := spool.SendEvent("first", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	generator := fixedGenerator{1, 2, 3}
+
+	// Replay runs apart from connection setup, its failure is logged
+	logger := make(testLogger)
+	failed := make(chan bool, 1)
+
+	go (func() {
+		for record := range logger {
+			if record["message"] == "Connection failed during spool replay, keeping spool" {
+				failed <- true
+			}
+		}
+	})()
+
+	// Connect over pipes and handshake manually, returns reader of frames
+	// connection writes and error of connection once it is created
+	connect := func() (*parser.Reader, *io.PipeReader, chan error) {
+
+		r1, w1 := io.Pipe()
+		r2, w2 := io.Pipe()
+
+		done := make(chan error, 1)
+
+		go (func() {
+			_, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+				Spool:       spool,
+				IdGenerator: generator,
+				Logger:      logger,
+			})
+			done <- err
+		})()
+
+		reader := parser.NewReader(r2, parser.Limits{})
+
+		if frame, err := reader.ReadFrame(); err != nil || frame.GetType() != parser.SYSTEM_HANDSHAKE {
+			t.Fatal("Expected handshake, got", frame, err)
+		}
+
+		go parser.WriteFrame(w1, &parser.SystemHandshake{Version: YAMP_VERSION})
+
+		reader.SetVersion(YAMP_VERSION)
+
+		return reader, r2, done
+	}
+
+	// Connection breaks before spooled frames are written
+	_, r, done := connect()
+	r.Close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-failed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected replay to fail")
+	}
+
+	if spool.Size() == 0 {
+		t.Fatal("Expected spool to be kept when replay failed")
+	}
+
+	if err := spool.SendEvent("second", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, _, done := connect()
+
+	for _, uri := range []string{"first", "second"} {
+
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		event, ok := frame.(*parser.Event)
+		if !ok || event.Uri != uri {
+			t.Fatal("Expected event", uri, "got", frame)
+		}
+
+		if uri == "second" && event.Uid != [16]byte(generator) {
+			t.Fatal("Expected uid of connection generator, got", event.Uid)
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	waitSpoolEmpty(t, spool)
+}
+
+//
+// Test spooled requests over limit of outstanding requests
+// get error response instead of waiting for free slot
+//
+func TestSpoolPendingLimit(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "yamp-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(filepath.Join(dir, "spool"), &format.JsonBodyFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := spool.SendRequest("foo", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	responses := make(chan *api.Response, 3)
+	spool.ResponseHandler = func(response *api.Response) {
+		responses <- response
+	}
+
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+
+	go (func() {
+		_, err := NewConnectionWithOptions(true, &MockConnection{r1, w2}, &format.JsonBodyFormat{}, Options{
+			Spool:              spool,
+			MaxPendingRequests: 1,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})()
+
+	// Other party handshakes but never responds
+	reader := parser.NewReader(r2, parser.Limits{})
+
+	if frame, err := reader.ReadFrame(); err != nil || frame.GetType() != parser.SYSTEM_HANDSHAKE {
+		t.Fatal("Expected handshake, got", frame, err)
+	}
+
+	go parser.WriteFrame(w1, &parser.SystemHandshake{Version: YAMP_VERSION})
+	go io.Copy(ioutil.Discard, r2)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case response := <-responses:
+			var body string
+			response.Read(&body)
+			if !response.IsError() || body != ErrTooManyPending.Error() {
+				t.Fatal("Expected too many pending error, got", body)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected requests over limit to be answered")
+		}
+	}
+
+	waitSpoolEmpty(t, spool)
+}
+
+//
+// Wait for spool to be emptied by replay
+//
+func waitSpoolEmpty(t *testing.T, spool *Spool) {
+
+	deadline := time.Now().Add(time.Second)
+
+	for spool.Size() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected spool to be empty after replay, got", spool.Size())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
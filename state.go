@@ -0,0 +1,141 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"fmt"
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/parser"
+	"sync/atomic"
+)
+
+var (
+
+	// Returned when sending over connection that is closing or closed
+	ErrClosed = api.ErrClosed
+)
+
+//
+// State of connection lifecycle. Connection moves only forward
+// through states, from STATE_HANDSHAKING to STATE_CLOSED
+//
+type State uint32
+
+const (
+
+	// Handshake is in progress, no user frames are allowed
+	STATE_HANDSHAKING State = iota
+
+	// Handshake succeeded, frames flow both ways
+	STATE_OPEN
+
+	// Close frame was sent or received, no more user frames are allowed
+	STATE_CLOSING
+
+	// Connection is done, either closed or failed
+	STATE_CLOSED
+)
+
+//
+// String returns name of state
+//
+func (s State) String() string {
+
+	switch s {
+	case STATE_HANDSHAKING:
+		return "handshaking"
+	case STATE_OPEN:
+		return "open"
+	case STATE_CLOSING:
+		return "closing"
+	case STATE_CLOSED:
+		return "closed"
+	}
+
+	return fmt.Sprintf("state(%d)", uint32(s))
+}
+
+//
+// StateHandler is called on every connection state transition
+//
+type StateHandler func(from, to State)
+
+//
+// State returns current state of connection
+//
+func (c *Connection) State() State {
+	return State(atomic.LoadUint32(&c.state))
+}
+
+//
+// OnStateChange adds handler of state transitions. Handlers are
+// called synchronously from goroutine making transition, so they
+// should not block. Use Options.OnStateChange to see transitions
+// happening during handshake
+//
+func (c *Connection) OnStateChange(handler StateHandler) {
+
+	c.stateHandlersLock.Lock()
+	defer c.stateHandlersLock.Unlock()
+
+	c.stateHandlers = append(c.stateHandlers, handler)
+}
+
+//
+// Move connection to state if it is later than current one.
+// Returns false if connection is already there or further
+//
+func (c *Connection) setState(to State) bool {
+
+	for {
+		from := c.State()
+		if from >= to {
+			return false
+		}
+
+		if atomic.CompareAndSwapUint32(&c.state, uint32(from), uint32(to)) {
+			c.notifyState(from, to)
+			return true
+		}
+	}
+}
+
+func (c *Connection) notifyState(from, to State) {
+
+	c.stateHandlersLock.RLock()
+	handlers := c.stateHandlers
+	c.stateHandlersLock.RUnlock()
+
+	for _, handler := range handlers {
+		handler(from, to)
+	}
+}
+
+//
+// Check that frame is allowed in current state. User frames are
+// not allowed after other party sent close frame
+//
+func (c *Connection) checkFrameIn(frame parser.Frame) error {
+
+	if !c.closeReceived || isSystemFrame(frame) {
+		return nil
+	}
+
+	return &parser.ProtocolError{
+		Code:    parser.CLOSE_PROTOCOL_ERROR,
+		Message: fmt.Sprintf("Unexpected %s frame after close", frame.GetType()),
+	}
+}
+
+//
+// System frames are allowed in any state
+//
+func isSystemFrame(frame parser.Frame) bool {
+	switch frame.GetType() {
+	case parser.SYSTEM_HANDSHAKE, parser.SYSTEM_CLOSE, parser.SYSTEM_PING:
+		return true
+	}
+	return false
+}
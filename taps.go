@@ -0,0 +1,68 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package yamp
+
+import (
+	"github.com/yyyar/yamp-go/api"
+	"github.com/yyyar/yamp-go/parser"
+)
+
+//
+// OnFrameIn adds hook called with every frame received from other
+// party, including system frames and fragments, before it is dispatched.
+// Hooks are called from connection read loop, so they should neither
+// block nor modify frame. Use Options.OnFrameIn to see handshake frames too
+//
+func (c *Connection) OnFrameIn(hook api.FrameHandler) {
+
+	c.tapsLock.Lock()
+	defer c.tapsLock.Unlock()
+
+	c.tapsIn = append(c.tapsIn, hook)
+}
+
+//
+// OnFrameOut adds hook called with every frame sent to other party,
+// including system frames and fragments, before it is serialized.
+// Hooks are called from connection write loop, so they should neither
+// block nor modify frame. Use Options.OnFrameOut to see handshake frames too
+//
+func (c *Connection) OnFrameOut(hook api.FrameHandler) {
+
+	c.tapsLock.Lock()
+	defer c.tapsLock.Unlock()
+
+	c.tapsOut = append(c.tapsOut, hook)
+}
+
+//
+// Account received frame and pass it to hooks
+//
+func (c *Connection) frameIn(frame parser.Frame) {
+
+	c.metrics.FrameIn(frame.GetType().String())
+
+	c.tapsLock.RLock()
+	taps := c.tapsIn
+	c.tapsLock.RUnlock()
+
+	for _, tap := range taps {
+		tap(frame)
+	}
+}
+
+//
+// Pass frame about to be sent to hooks
+//
+func (c *Connection) frameOut(frame parser.Frame) {
+
+	c.tapsLock.RLock()
+	taps := c.tapsOut
+	c.tapsLock.RUnlock()
+
+	for _, tap := range taps {
+		tap(frame)
+	}
+}
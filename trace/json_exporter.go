@@ -0,0 +1,116 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package trace
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/yyyar/yamp-go/logging"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// JsonExporter writes finished spans as JSON lines,
+// one object per span, for offline analysis
+//
+type JsonExporter struct {
+	sync.Mutex
+
+	writer  io.Writer
+	encoder *json.Encoder
+
+	// Logger of export errors
+	Logger logging.Logger
+}
+
+//
+// Span representation written by JsonExporter
+//
+type jsonSpan struct {
+	TraceId    string            `json:"trace_id"`
+	SpanId     string            `json:"span_id"`
+	ParentId   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Kind       SpanKind          `json:"kind"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Duration   int64             `json:"duration_us"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+//
+// NewJsonExporter creates exporter writing spans to writer
+//
+func NewJsonExporter(writer io.Writer) *JsonExporter {
+	return &JsonExporter{
+		writer:  writer,
+		encoder: json.NewEncoder(writer),
+		Logger:  logging.Default,
+	}
+}
+
+//
+// NewJsonFileExporter creates exporter appending spans to file at path
+//
+func NewJsonFileExporter(path string) (*JsonExporter, error) {
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewJsonExporter(file), nil
+}
+
+//
+// Export writes span as single JSON line
+//
+func (e *JsonExporter) Export(span *Span) {
+
+	span.Lock()
+
+	record := jsonSpan{
+		TraceId:    hex.EncodeToString(span.Context.TraceId[:]),
+		SpanId:     hex.EncodeToString(span.Context.SpanId[:]),
+		Name:       span.Name,
+		Kind:       span.Kind,
+		Start:      span.Start,
+		End:        span.End,
+		Duration:   int64(span.End.Sub(span.Start) / time.Microsecond),
+		Attributes: make(map[string]string, len(span.Attributes)),
+	}
+
+	for k, v := range span.Attributes {
+		record.Attributes[k] = v
+	}
+
+	if span.ParentId != [8]byte{} {
+		record.ParentId = hex.EncodeToString(span.ParentId[:])
+	}
+
+	span.Unlock()
+
+	e.Lock()
+	defer e.Unlock()
+
+	if err := e.encoder.Encode(&record); err != nil {
+		e.Logger.Log(logging.LEVEL_ERROR, "Unable to export span", logging.F(logging.FIELD_ERROR, err))
+	}
+}
+
+//
+// Close closes underlying writer if it is closable
+//
+func (e *JsonExporter) Close() error {
+
+	if closer, ok := e.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package trace
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// SpanKind is role of span in a call
+//
+type SpanKind string
+
+const (
+	SPAN_KIND_CLIENT   SpanKind = "client"
+	SPAN_KIND_SERVER   SpanKind = "server"
+	SPAN_KIND_PRODUCER SpanKind = "producer"
+	SPAN_KIND_CONSUMER SpanKind = "consumer"
+)
+
+//
+// Span attributes set by yamp
+//
+const (
+	ATTRIBUTE_URI           = "yamp.uri"
+	ATTRIBUTE_UID           = "yamp.uid"
+	ATTRIBUTE_RESPONSE_TYPE = "yamp.response_type"
+)
+
+//
+// Span is single timed operation: handler execution or client call
+//
+type Span struct {
+	sync.Mutex
+
+	Name     string
+	Kind     SpanKind
+	Context  SpanContext
+	ParentId [8]byte
+
+	Start time.Time
+	End   time.Time
+
+	Attributes map[string]string
+
+	// Exporter to send finished span to
+	exporter Exporter
+
+	// Indicates that span was already finished
+	finished bool
+}
+
+//
+// SetAttribute sets attribute of span
+//
+func (s *Span) SetAttribute(key, value string) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.Attributes[key] = value
+}
+
+//
+// Finish ends span and exports it. Subsequent calls do nothing
+//
+func (s *Span) Finish() {
+
+	s.Lock()
+
+	if s.finished {
+		s.Unlock()
+		return
+	}
+
+	s.finished = true
+	s.End = time.Now()
+
+	s.Unlock()
+
+	if s.exporter != nil {
+		s.exporter.Export(s)
+	}
+}
@@ -0,0 +1,122 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+//
+// Metadata header carrying W3C trace context
+//
+const TRACEPARENT_HEADER = "traceparent"
+
+//
+// Trace flag indicating that trace is sampled
+//
+const FLAG_SAMPLED byte = 0x01
+
+//
+// SpanContext identifies span within trace and is propagated
+// between parties in traceparent header
+//
+type SpanContext struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	Flags   byte
+}
+
+//
+// IsValid indicates that span context has non-zero ids
+//
+func (c SpanContext) IsValid() bool {
+	return c.TraceId != [16]byte{} && c.SpanId != [8]byte{}
+}
+
+//
+// Traceparent formats span context as W3C traceparent header value
+//
+func (c SpanContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(c.TraceId[:]) + "-" +
+		hex.EncodeToString(c.SpanId[:]) + "-" + hex.EncodeToString([]byte{c.Flags})
+}
+
+//
+// ParseTraceparent parses W3C traceparent header value.
+// Returns false if value is malformed
+//
+func ParseTraceparent(value string) (SpanContext, bool) {
+
+	var c SpanContext
+
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return c, false
+	}
+
+	// Version 00 has exactly 4 parts, future versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return c, false
+	}
+
+	var flags [1]byte
+
+	if !decodeHex(c.TraceId[:], parts[1]) || !decodeHex(c.SpanId[:], parts[2]) || !decodeHex(flags[:], parts[3]) {
+		return c, false
+	}
+
+	c.Flags = flags[0]
+
+	return c, c.IsValid()
+}
+
+//
+// Decode hex string of exactly len(to) bytes
+//
+func decodeHex(to []byte, s string) bool {
+
+	if len(s) != hex.EncodedLen(len(to)) || strings.ToLower(s) != s {
+		return false
+	}
+
+	_, err := hex.Decode(to, []byte(s))
+	return err == nil
+}
+
+//
+// Fill b with random bytes
+//
+func randomId(b []byte) {
+	rand.Read(b)
+}
+
+//
+// Key of span context in context.Context
+//
+type contextKey struct{}
+
+//
+// NewContext returns copy of ctx carrying span context, so spans
+// started with it (including client calls) become its children
+//
+func NewContext(ctx context.Context, span SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, span)
+}
+
+//
+// FromContext returns span context carried by ctx
+//
+func FromContext(ctx context.Context) (SpanContext, bool) {
+
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+
+	span, ok := ctx.Value(contextKey{}).(SpanContext)
+	return span, ok
+}
@@ -0,0 +1,90 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+//
+// Test traceparent is formatted and parsed back
+//
+func TestTraceparent(t *testing.T) {
+
+	span := NewTracer(nil).StartSpan("foo", SPAN_KIND_CLIENT, SpanContext{})
+
+	parsed, ok := ParseTraceparent(span.Context.Traceparent())
+	if !ok || parsed != span.Context {
+		t.Fatal("Expected", span.Context, "got", parsed)
+	}
+
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(value); ok {
+			t.Fatal("Expected malformed traceparent", value)
+		}
+	}
+
+	if _, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"); !ok {
+		t.Fatal("Expected valid traceparent")
+	}
+}
+
+//
+// Test child spans continue trace of parent from context
+// and are exported as JSON lines
+//
+func TestJsonExporter(t *testing.T) {
+
+	var buffer bytes.Buffer
+
+	tracer := NewTracer(NewJsonExporter(&buffer))
+
+	root := tracer.StartSpan("root", SPAN_KIND_SERVER, SpanContext{})
+
+	parent, ok := FromContext(NewContext(context.Background(), root.Context))
+	if !ok {
+		t.Fatal("Expected span context in context")
+	}
+
+	child := tracer.StartSpan("child", SPAN_KIND_CLIENT, parent)
+	child.SetAttribute(ATTRIBUTE_URI, "child")
+	child.Finish()
+	child.Finish()
+	root.Finish()
+
+	decoder := json.NewDecoder(&buffer)
+
+	var spans []jsonSpan
+
+	for decoder.More() {
+		var span jsonSpan
+		if err := decoder.Decode(&span); err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, span)
+	}
+
+	if len(spans) != 2 {
+		t.Fatal("Expected 2 spans exported once each, got", len(spans))
+	}
+
+	if spans[0].Name != "child" || spans[0].TraceId != spans[1].TraceId || spans[0].ParentId != spans[1].SpanId {
+		t.Fatal("Expected child span of root, got", spans)
+	}
+
+	if spans[0].Attributes[ATTRIBUTE_URI] != "child" || spans[1].ParentId != "" {
+		t.Fatal("Unexpected spans", spans)
+	}
+}
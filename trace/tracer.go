@@ -0,0 +1,60 @@
+//
+// Copyright 2017 Yaroslav Pogrebnyak <yyyaroslav@gmail.com>
+//
+
+package trace
+
+import (
+	"time"
+)
+
+//
+// Exporter receives finished spans
+//
+type Exporter interface {
+	Export(span *Span)
+}
+
+//
+// Tracer starts spans and sends them to exporter once finished
+//
+type Tracer struct {
+	Exporter Exporter
+}
+
+//
+// NewTracer creates tracer exporting spans to exporter
+//
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{
+		Exporter: exporter,
+	}
+}
+
+//
+// StartSpan starts span as child of parent, or as root
+// of new trace if parent is not valid
+//
+func (t *Tracer) StartSpan(name string, kind SpanKind, parent SpanContext) *Span {
+
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+		exporter:   t.Exporter,
+	}
+
+	if parent.IsValid() {
+		span.Context.TraceId = parent.TraceId
+		span.Context.Flags = parent.Flags
+		span.ParentId = parent.SpanId
+	} else {
+		randomId(span.Context.TraceId[:])
+		span.Context.Flags = FLAG_SAMPLED
+	}
+
+	randomId(span.Context.SpanId[:])
+
+	return span
+}